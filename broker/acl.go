@@ -0,0 +1,215 @@
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+// Access is the kind of access a client asks for on a topic.
+type Access byte
+
+const (
+	AccessRead      Access = 1 << iota // subscribe to the topic
+	AccessWrite                        // publish to the topic
+	AccessReadWrite = AccessRead | AccessWrite
+)
+
+// An Authorizer decides whether a connected client may publish or
+// subscribe to a topic.
+type Authorizer interface {
+	// Authorize is called with the CONNECT packet of the client. For
+	// AccessWrite, topic is the topic name of a PUBLISH; for AccessRead
+	// it is a topic filter from a SUBSCRIBE and may contain wildcards.
+	Authorize(m *packets.ConnectPacket, topic string, access Access) bool
+}
+
+// The AuthorizerFunc type is an adapter to allow the use of ordinary
+// functions as Authorizers.
+type AuthorizerFunc func(m *packets.ConnectPacket, topic string, access Access) bool
+
+// Authorize calls f(m, topic, access).
+func (f AuthorizerFunc) Authorize(m *packets.ConnectPacket, topic string, access Access) bool {
+	return f(m, topic, access)
+}
+
+type aclRule struct {
+	topic  string
+	access Access
+}
+
+// An ACL is an Authorizer made of rules in the style of mosquitto's
+// acl_file. Topic rules belong to a single user, or to clients without a
+// username when the user is empty. Pattern rules apply to every client,
+// with %u replaced by the username and %c by the client id. Anything not
+// granted by a rule is denied.
+type ACL struct {
+	path     string
+	mu       sync.RWMutex
+	users    map[string][]aclRule
+	patterns []aclRule
+}
+
+// NewACL creates an empty ACL, which denies everything.
+func NewACL() *ACL {
+	return &ACL{users: make(map[string][]aclRule)}
+}
+
+// NewACLFile loads an ACL from a mosquitto acl_file at path. The file
+// holds "user <username>", "topic [read|write|readwrite] <topic>" and
+// "pattern [read|write|readwrite] <topic>" lines; topic lines before the
+// first user line apply to anonymous clients.
+func NewACLFile(path string) (*ACL, error) {
+	a := NewACL()
+	a.path = path
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload rereads the file the ACL was loaded from, replacing all rules.
+// On error the previous rules are kept. It does nothing for an ACL not
+// created by NewACLFile.
+func (a *ACL) Reload() error {
+	if a.path == "" {
+		return nil
+	}
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	acl := NewACL()
+	user := ""
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: invalid line %q", a.path, n, line)
+		}
+		arg := strings.TrimSpace(fields[1])
+		switch fields[0] {
+		case "user":
+			user = arg
+		case "topic", "pattern":
+			access, topic := AccessReadWrite, arg
+			if f := strings.SplitN(arg, " ", 2); len(f) == 2 {
+				switch f[0] {
+				case "read":
+					access, topic = AccessRead, strings.TrimSpace(f[1])
+				case "write":
+					access, topic = AccessWrite, strings.TrimSpace(f[1])
+				case "readwrite":
+					topic = strings.TrimSpace(f[1])
+				default:
+					return fmt.Errorf("%s:%d: unknown access %q", a.path, n, f[0])
+				}
+			}
+			if fields[0] == "topic" {
+				acl.users[user] = append(acl.users[user], aclRule{topic: topic, access: access})
+			} else {
+				acl.patterns = append(acl.patterns, aclRule{topic: topic, access: access})
+			}
+		default:
+			return fmt.Errorf("%s:%d: unknown keyword %q", a.path, n, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.users, a.patterns = acl.users, acl.patterns
+	a.mu.Unlock()
+	return nil
+}
+
+// AddTopic grants access to a topic filter to the given user, or to
+// anonymous clients when user is empty.
+func (a *ACL) AddTopic(user, topic string, access Access) {
+	a.mu.Lock()
+	a.users[user] = append(a.users[user], aclRule{topic: topic, access: access})
+	a.mu.Unlock()
+}
+
+// AddPattern grants access to a topic filter to every client, after
+// substituting %u and %c.
+func (a *ACL) AddPattern(pattern string, access Access) {
+	a.mu.Lock()
+	a.patterns = append(a.patterns, aclRule{topic: pattern, access: access})
+	a.mu.Unlock()
+}
+
+// Authorize implements Authorizer.
+func (a *ACL) Authorize(m *packets.ConnectPacket, topic string, access Access) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, r := range a.users[m.Username] {
+		if r.access&access == access && aclMatches(r.topic, topic) {
+			return true
+		}
+	}
+	for _, r := range a.patterns {
+		if r.access&access != access {
+			continue
+		}
+		filter, ok := substitute(r.topic, m)
+		if ok && aclMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// substitute replaces %u and %c in an ACL pattern. It fails when the
+// pattern needs a username or client id the client does not have, or
+// when the values would introduce extra levels or wildcards.
+func substitute(pattern string, m *packets.ConnectPacket) (string, bool) {
+	if strings.Contains(pattern, "%u") {
+		if !m.UsernameFlag || m.Username == "" || strings.ContainsAny(m.Username, "/+#") {
+			return "", false
+		}
+		pattern = strings.Replace(pattern, "%u", m.Username, -1)
+	}
+	if strings.Contains(pattern, "%c") {
+		if m.ClientIdentifier == "" || strings.ContainsAny(m.ClientIdentifier, "/+#") {
+			return "", false
+		}
+		pattern = strings.Replace(pattern, "%c", m.ClientIdentifier, -1)
+	}
+	return pattern, true
+}
+
+// aclMatches reports whether the ACL filter covers the topic; when topic
+// is itself a filter, it must cover every topic the filter can match.
+// Wildcards at the first level never cover topics starting with $.
+func aclMatches(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (f[0] == "+" || f[0] == "#") {
+		return false
+	}
+	for i, part := range f {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) || t[i] == "#" {
+			return false
+		}
+		if part != "+" && part != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+func TestACL(t *testing.T) {
+	a := NewACL()
+	a.AddTopic("", "public/#", AccessRead)
+	a.AddTopic("alice", "alice/#", AccessReadWrite)
+	a.AddTopic("alice", "news", AccessRead)
+	a.AddPattern("users/%u/#", AccessReadWrite)
+	a.AddPattern("devices/%c/status", AccessWrite)
+
+	alice := &packets.ConnectPacket{ClientIdentifier: "phone", Username: "alice", UsernameFlag: true}
+	anon := &packets.ConnectPacket{ClientIdentifier: "sensor"}
+	evil := &packets.ConnectPacket{ClientIdentifier: "x/#", Username: "a/+", UsernameFlag: true}
+	tests := []struct {
+		m      *packets.ConnectPacket
+		topic  string
+		access Access
+		want   bool
+	}{
+		// Topic rules belong to their user.
+		{alice, "alice/x", AccessWrite, true},
+		{alice, "alice/#", AccessRead, true},
+		{alice, "news", AccessRead, true},
+		{alice, "news", AccessWrite, false},
+		{anon, "alice/x", AccessRead, false},
+		// Those before any user line are for anonymous clients only.
+		{anon, "public/a", AccessRead, true},
+		{anon, "public/a", AccessWrite, false},
+		{alice, "public/a", AccessRead, false},
+		// Patterns apply to everyone, with %u and %c substituted.
+		{alice, "users/alice/x", AccessReadWrite, true},
+		{alice, "users/bob/x", AccessRead, false},
+		{alice, "users/+/x", AccessRead, false},
+		{anon, "users//x", AccessRead, false},
+		{alice, "devices/phone/status", AccessWrite, true},
+		{anon, "devices/sensor/status", AccessWrite, true},
+		{anon, "devices/phone/status", AccessWrite, false},
+		{anon, "devices/sensor/status", AccessRead, false},
+		// Values that would add levels or wildcards match nothing.
+		{evil, "users/a/+/x", AccessRead, false},
+		{evil, "devices/x/#/status", AccessWrite, false},
+		// Wildcards at the first level do not cover $ topics.
+		{alice, "$SYS/x", AccessRead, false},
+	}
+	for _, tt := range tests {
+		if got := a.Authorize(tt.m, tt.topic, tt.access); got != tt.want {
+			t.Errorf("%s/%s %s %d: got %v, want %v", tt.m.Username, tt.m.ClientIdentifier, tt.topic, tt.access, got, tt.want)
+		}
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl")
+	content := "# anonymous\n" +
+		"topic read public/#\n" +
+		"user alice\n" +
+		"topic alice/#\n" +
+		"topic write log\n" +
+		"pattern readwrite devices/%c/#\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewACLFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := &packets.ConnectPacket{ClientIdentifier: "c1", Username: "alice", UsernameFlag: true}
+	anon := &packets.ConnectPacket{ClientIdentifier: "c2"}
+	if !a.Authorize(alice, "alice/x", AccessReadWrite) || !a.Authorize(alice, "log", AccessWrite) || a.Authorize(alice, "log", AccessRead) {
+		t.Error("user rules not applied")
+	}
+	if !a.Authorize(anon, "public/x", AccessRead) || a.Authorize(alice, "public/x", AccessRead) {
+		t.Error("anonymous rules not applied")
+	}
+	if !a.Authorize(anon, "devices/c2/x", AccessRead) || a.Authorize(anon, "devices/c1/x", AccessRead) {
+		t.Error("pattern not applied")
+	}
+
+	// A bad file keeps the rules loaded before.
+	if err := os.WriteFile(path, []byte("topic sometimes x\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err == nil {
+		t.Fatal("no error for an unknown access")
+	}
+	if !a.Authorize(alice, "alice/x", AccessRead) {
+		t.Error("rules lost after a failed Reload")
+	}
+}
+
+func TestACLAssignedClientID(t *testing.T) {
+	a := NewACL()
+	a.AddPattern("devices/%c/#", AccessReadWrite)
+	s := newTestServer(t, func(s *Server) { s.Authz = a })
+
+	// Clients without an id get one of their own for %c, not a namespace
+	// shared by all of them.
+	m := newConnect("", true)
+	m.ProtocolVersion = packets.Version5
+	c, connack := connectTo(t, s, m)
+	if connack == nil || connack.Properties == nil || connack.Properties.AssignedClientID == "" {
+		t.Fatalf("got %v, want an assigned client id", connack)
+	}
+	granted := func(id uint16, filter string) bool {
+		sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		sub.PacketID, sub.Topics, sub.Qoss = id, []string{filter}, []byte{0}
+		c.send(sub)
+		sa, ok := c.read(2 * time.Second).(*packets.SubackPacket)
+		if !ok {
+			t.Fatalf("no SUBACK for %s", filter)
+		}
+		return sa.GrantedQoss[0] < 0x80
+	}
+	if !granted(1, "devices/"+connack.Properties.AssignedClientID+"/#") {
+		t.Error("denied the namespace of the assigned id")
+	}
+	if granted(2, "devices//#") {
+		t.Error("granted the namespace of an empty id")
+	}
+}
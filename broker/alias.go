@@ -0,0 +1,80 @@
+package broker
+
+import (
+	"container/list"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+// The topic aliases used for the PUBLISH packets sent to a client, up to
+// the Topic Alias Maximum from its CONNECT. Once all aliases are taken,
+// the least recently used one is given to the next new topic.
+type topicAliases struct {
+	max    uint16
+	topics map[string]*list.Element // of *topicAlias
+	lru    *list.List               // most recently used first
+}
+
+type topicAlias struct {
+	topic string
+	alias uint16
+}
+
+func newTopicAliases(max uint16) *topicAliases {
+	return &topicAliases{
+		max:    max,
+		topics: make(map[string]*list.Element),
+		lru:    list.New(),
+	}
+}
+
+// Find the alias of a topic, assigning one if needed. Known is true if
+// the client already has the alias, so that the topic name can be left
+// out.
+func (a *topicAliases) get(topic string) (alias uint16, known bool) {
+	if e, ok := a.topics[topic]; ok {
+		a.lru.MoveToFront(e)
+		return e.Value.(*topicAlias).alias, true
+	}
+	if a.lru.Len() < int(a.max) {
+		alias = uint16(a.lru.Len() + 1)
+	} else {
+		e := a.lru.Back()
+		old := a.lru.Remove(e).(*topicAlias)
+		delete(a.topics, old.topic)
+		alias = old.alias
+	}
+	a.topics[topic] = a.lru.PushFront(&topicAlias{topic: topic, alias: alias})
+	return alias, false
+}
+
+// Resolve the Topic Alias of an inbound PUBLISH against the aliases the
+// client set up on this connection, recording a new one if the packet
+// has a topic name too. The alias is removed from the packet. It returns
+// a reason code other than ReasonSuccess for a protocol error.
+func (c *incomingConn) resolveAlias(m *packets.PublishPacket) byte {
+	if m.Properties == nil || m.Properties.TopicAlias == nil {
+		if m.TopicName == "" {
+			return packets.ReasonProtocolError
+		}
+		return packets.ReasonSuccess
+	}
+	alias := *m.Properties.TopicAlias
+	m.Properties.TopicAlias = nil
+	if alias == 0 || alias > c.svr.TopicAliasMaximum {
+		return packets.ReasonTopicAliasInvalid
+	}
+	if m.TopicName != "" {
+		if c.aliases == nil {
+			c.aliases = make(map[uint16]string)
+		}
+		c.aliases[alias] = m.TopicName
+		return packets.ReasonSuccess
+	}
+	topic, ok := c.aliases[alias]
+	if !ok {
+		return packets.ReasonProtocolError
+	}
+	m.TopicName = topic
+	return packets.ReasonSuccess
+}
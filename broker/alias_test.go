@@ -0,0 +1,131 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+func TestTopicAliasesLRU(t *testing.T) {
+	a := newTopicAliases(2)
+	tests := []struct {
+		topic string
+		alias uint16
+		known bool
+	}{
+		{"a", 1, false},
+		{"b", 2, false},
+		{"a", 1, true},
+		// Full: b, the least recently used, gives up its alias.
+		{"c", 2, false},
+		{"a", 1, true},
+		// Then c, as a was just used; b comes back with the full topic.
+		{"b", 2, false},
+		{"c", 1, false},
+		{"b", 2, true},
+	}
+	for i, tt := range tests {
+		alias, known := a.get(tt.topic)
+		if alias != tt.alias || known != tt.known {
+			t.Fatalf("%d: get(%q) = %d, %v, want %d, %v", i, tt.topic, alias, known, tt.alias, tt.known)
+		}
+	}
+}
+
+// aliasPublish returns a PUBLISH with a Topic Alias.
+func aliasPublish(topic string, alias uint16, payload string) *packets.PublishPacket {
+	p := newPublish(0, topic, 0, payload)
+	p.Properties = &packets.Properties{TopicAlias: packets.Uint16(alias)}
+	return p
+}
+
+func TestInboundTopicAlias(t *testing.T) {
+	s := newTestServer(t, nil)
+	sub, _ := connectTo(t, s, newConnect("sub", true))
+	sub.subscribe(1, "#", 0)
+	connect5 := func(id string) *testClient {
+		m := newConnect(id, true)
+		m.ProtocolVersion = packets.Version5
+		c, connack := connectTo(t, s, m)
+		if connack == nil || connack.Properties.TopicAliasMaximum == nil || *connack.Properties.TopicAliasMaximum != 10 {
+			t.Fatalf("got %v, want a Topic Alias Maximum of 10", connack)
+		}
+		return c
+	}
+
+	// An alias set up with a topic stands for it in the next PUBLISH, and
+	// may be set to another topic.
+	pub := connect5("pub")
+	pub.send(aliasPublish("a/b", 1, "set"))
+	pub.send(aliasPublish("", 1, "used"))
+	pub.send(aliasPublish("c", 1, "reset"))
+	pub.send(aliasPublish("", 1, "used again"))
+	for _, want := range []struct{ topic, payload string }{
+		{"a/b", "set"}, {"a/b", "used"}, {"c", "reset"}, {"c", "used again"},
+	} {
+		p := sub.readPublish(2 * time.Second)
+		if p == nil || p.TopicName != want.topic || string(p.Payload) != want.payload {
+			t.Fatalf("got %v, want %q on %s", p, want.payload, want.topic)
+		}
+	}
+
+	// Aliases belong to the connection they were set up on.
+	tests := []struct {
+		name   string
+		p      *packets.PublishPacket
+		reason byte
+	}{
+		{"alias 0", aliasPublish("a/b", 0, "x"), packets.ReasonTopicAliasInvalid},
+		{"alias above the maximum", aliasPublish("a/b", 11, "x"), packets.ReasonTopicAliasInvalid},
+		{"unknown alias", aliasPublish("", 2, "x"), packets.ReasonProtocolError},
+		{"no topic nor alias", newPublish(0, "", 0, "x"), packets.ReasonProtocolError},
+	}
+	for _, tt := range tests {
+		c := connect5(tt.name)
+		c.send(tt.p)
+		d, ok := c.read(2 * time.Second).(*packets.DisconnectPacket)
+		if !ok || d.ReasonCode != tt.reason {
+			t.Errorf("%s: got %v, want a DISCONNECT with reason 0x%02X", tt.name, d, tt.reason)
+		}
+	}
+	if p := sub.readPublish(300 * time.Millisecond); p != nil {
+		t.Fatalf("got %q from a PUBLISH with a bad alias", p.Payload)
+	}
+}
+
+func TestOutboundTopicAlias(t *testing.T) {
+	s := newTestServer(t, nil)
+	m := newConnect("sub", true)
+	m.ProtocolVersion = packets.Version5
+	m.Properties = &packets.Properties{TopicAliasMaximum: packets.Uint16(2)}
+	sub, _ := connectTo(t, s, m)
+	sub.subscribe(1, "#", 0)
+	pub, _ := connectTo(t, s, newConnect("pub", true))
+
+	// The topic is sent with a new alias, then left out while the client
+	// has it; once evicted, it is sent in full again.
+	tests := []struct {
+		topic string
+		sent  string
+		alias uint16
+	}{
+		{"a", "a", 1},
+		{"b", "b", 2},
+		{"a", "", 1},
+		{"c", "c", 2},
+		{"b", "b", 1},
+		{"c", "", 2},
+		{"a", "a", 1},
+	}
+	for i, tt := range tests {
+		pub.send(newPublish(0, tt.topic, 0, tt.topic))
+		p := sub.readPublish(2 * time.Second)
+		if p == nil || p.Properties == nil || p.Properties.TopicAlias == nil {
+			t.Fatalf("%d: got %v, want a PUBLISH with a topic alias", i, p)
+		}
+		if p.TopicName != tt.sent || *p.Properties.TopicAlias != tt.alias || string(p.Payload) != tt.topic {
+			t.Fatalf("%d: got topic %q alias %d for %s, want %q alias %d", i, p.TopicName, *p.Properties.TopicAlias, p.Payload, tt.sent, tt.alias)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+// An Authenticator decides whether a client is allowed to connect.
+type Authenticator interface {
+	// Authenticate is called with the remote address and the CONNECT
+	// packet of a client, once the packet has been validated. It returns
+	// packets.Accepted to let the client in, or a CONNACK return code such
+	// as packets.ErrRefusedBadUsernameOrPassword or
+	// packets.ErrRefusedNotAuthorised to refuse it.
+	Authenticate(addr net.Addr, m *packets.ConnectPacket) byte
+}
+
+// The AuthenticatorFunc type is an adapter to allow the use of ordinary
+// functions as Authenticators.
+type AuthenticatorFunc func(addr net.Addr, m *packets.ConnectPacket) byte
+
+// Authenticate calls f(addr, m).
+func (f AuthenticatorFunc) Authenticate(addr net.Addr, m *packets.ConnectPacket) byte {
+	return f(addr, m)
+}
+
+// An AuthMethod is an MQTT 5 enhanced authentication method, such as
+// SCRAM-SHA-256. A client names the method in the properties of its
+// CONNECT, then authenticates through challenges and responses carried
+// by AUTH packets. The same exchange runs again when the client asks to
+// re-authenticate on a live connection. Clients using an AuthMethod are
+// not passed to the Server's Authenticator.
+type AuthMethod interface {
+	// Name returns the Authentication Method clients ask for.
+	Name() string
+
+	// Start begins an exchange for the client of a CONNECT.
+	Start(m *packets.ConnectPacket) AuthExchange
+}
+
+// An AuthExchange is one run of an AuthMethod with one client.
+type AuthExchange interface {
+	// Next takes the Authentication Data sent by the client and returns
+	// the data to send back. Done is true once the client has proven who
+	// it is; an error means it has failed to.
+	Next(data []byte) (out []byte, done bool, err error)
+
+	// Username returns the user authenticated by the exchange, once done.
+	// It is the user name that the Authorizer gets to see.
+	Username() string
+}
+
+// Begin the enhanced authentication of a CONNECT with the method the
+// client asks for. The connection is accepted once the exchange is
+// done; an error means the client has been refused.
+func (c *incomingConn) startAuth(m *packets.ConnectPacket) error {
+	method := c.svr.authMethod(m.Properties.AuthMethod)
+	if method == nil {
+		c.refuseReason(packets.ReasonBadAuthenticationMethod)
+		return fmt.Errorf("unsupported authentication method %q", m.Properties.AuthMethod)
+	}
+	c.authMethod = method.Name()
+	c.exchange = method.Start(m)
+	c.pending = m
+	if err := c.authenticate(m.Properties.AuthData); err != nil {
+		c.authFailed(packets.ReasonNotAuthorized)
+		return err
+	}
+	return nil
+}
+
+// Handle an AUTH packet from the client: the next step of an exchange in
+// progress, or a request to re-authenticate with the method of the
+// CONNECT. An error means the client has been told it failed.
+func (c *incomingConn) handleAuth(m *packets.AuthPacket) error {
+	var method string
+	var data []byte
+	if m.Properties != nil {
+		method, data = m.Properties.AuthMethod, m.Properties.AuthData
+	}
+	switch {
+	case c.authMethod == "" || method != c.authMethod:
+		c.authFailed(packets.ReasonProtocolError)
+		return fmt.Errorf("unexpected authentication method %q", method)
+	case m.ReasonCode == packets.ReasonReAuthenticate && c.exchange == nil && c.connect != nil:
+		c.exchange = c.svr.authMethod(method).Start(c.connect)
+	case m.ReasonCode == packets.ReasonContinueAuthentication && c.exchange != nil:
+	default:
+		c.authFailed(packets.ReasonProtocolError)
+		return fmt.Errorf("unexpected AUTH with reason code %#x", m.ReasonCode)
+	}
+
+	if err := c.authenticate(data); err != nil {
+		c.authFailed(packets.ReasonNotAuthorized)
+		return err
+	}
+	return nil
+}
+
+// Tell the client why enhanced authentication failed: in the CONNACK
+// while its CONNECT is pending, in a DISCONNECT afterwards.
+func (c *incomingConn) authFailed(reason byte) {
+	if c.connect == nil {
+		c.refuseReason(reason)
+	} else {
+		c.disconnect(reason)
+	}
+}
+
+// Pass authentication data from the client to the exchange in progress,
+// and send its answer: an AUTH asking to continue, or once done, the
+// CONNACK accepting the pending CONNECT, or an AUTH telling that
+// re-authentication succeeded.
+func (c *incomingConn) authenticate(data []byte) error {
+	out, done, err := c.exchange.Next(data)
+	if err != nil {
+		c.exchange = nil
+		return err
+	}
+	if !done {
+		c.sendAuth(packets.ReasonContinueAuthentication, out)
+		return nil
+	}
+
+	user := c.exchange.Username()
+	c.exchange = nil
+	if m := c.pending; m != nil {
+		c.pending = nil
+		if user != "" {
+			// The Authorizer knows clients by their user name.
+			m.Username, m.UsernameFlag = user, true
+		}
+		c.accept(m, out)
+		return nil
+	}
+	if user != "" {
+		// From now on the Authorizer checks the new identity.
+		m := *c.connect
+		m.Username, m.UsernameFlag = user, true
+		c.connect = &m
+	}
+	c.sendAuth(packets.ReasonSuccess, out)
+	return nil
+}
+
+func (c *incomingConn) sendAuth(reason byte, data []byte) {
+	auth := packets.NewControlPacket(packets.Auth).(*packets.AuthPacket)
+	auth.ReasonCode = reason
+	auth.Properties = &packets.Properties{AuthMethod: c.authMethod, AuthData: data}
+	c.submit(auth)
+}
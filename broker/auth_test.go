@@ -0,0 +1,74 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+func TestNoAuthenticator(t *testing.T) {
+	s := newTestServer(t, nil)
+	for _, version := range []byte{packets.Version311, packets.Version5} {
+		m := newConnect("c", true)
+		m.ProtocolVersion = version
+		m.Username, m.UsernameFlag = "anyone", true
+		m.Password, m.PasswordFlag = []byte("anything"), true
+		if _, connack := connectTo(t, s, m); connack == nil || connack.ReturnCode != packets.Accepted {
+			t.Fatalf("version %d: got %v, want the CONNECT accepted without an Authenticator", version, connack)
+		}
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	type call struct {
+		addr net.Addr
+		user string
+	}
+	calls := make(chan call, 1)
+	codes := make(chan byte, 1)
+	s := newTestServer(t, func(s *Server) {
+		s.Auth = AuthenticatorFunc(func(addr net.Addr, m *packets.ConnectPacket) byte {
+			calls <- call{addr, m.Username}
+			return <-codes
+		})
+	})
+
+	// The return code refuses MQTT 3.1.1 clients as it is, and MQTT 5
+	// clients with the reason code of the same meaning.
+	tests := []struct {
+		rc, reason byte
+	}{
+		{packets.Accepted, packets.ReasonSuccess},
+		{packets.ErrRefusedBadUsernameOrPassword, packets.ReasonBadUserNameOrPassword},
+		{packets.ErrRefusedNotAuthorised, packets.ReasonNotAuthorized},
+		{packets.ErrRefusedServerUnavailable, packets.ReasonServerUnavailable},
+	}
+	for _, tt := range tests {
+		for _, version := range []byte{packets.Version311, packets.Version5} {
+			codes <- tt.rc
+			m := newConnect("c", true)
+			m.ProtocolVersion = version
+			m.Username, m.UsernameFlag = "alice", true
+			c, connack := connectTo(t, s, m)
+			got := <-calls
+			if got.user != "alice" || got.addr.String() != c.conn.LocalAddr().String() {
+				t.Fatalf("Authenticator called for %s from %v, want alice from %v", got.user, got.addr, c.conn.LocalAddr())
+			}
+			want := tt.rc
+			if version == packets.Version5 {
+				want = tt.reason
+			}
+			if connack == nil || connack.ReturnCode != want {
+				t.Fatalf("version %d, return code %d: got %v, want a CONNACK with 0x%02X", version, tt.rc, connack, want)
+			}
+			if tt.rc == packets.Accepted {
+				continue
+			}
+			if m := c.read(2 * time.Second); m != nil {
+				t.Fatalf("version %d, return code %d: got %v, want the connection closed", version, tt.rc, m)
+			}
+		}
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"log"
 	"net"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/zwczou/mqtt/packets"
@@ -19,13 +19,23 @@ type incomingConn struct {
 	jobs           chan job
 	clientid       string
 	connect        *packets.ConnectPacket
+	version        byte // protocol version, from the CONNECT
+	sess           *session
+	aliases        map[uint16]string      // inbound topic aliases, used by the reader only
+	outAliases     *topicAliases          // outbound topic aliases, used by the writer only
+	receiveMax     uint16                 // the client's Receive Maximum, 0 if it has none
+	maxPacketSize  int                    // the client's Maximum Packet Size, 0 if it has none
+	authMethod     string                 // the MQTT 5 enhanced authentication method, if any
+	exchange       AuthExchange           // enhanced authentication in progress, used by the reader only
+	pending        *packets.ConnectPacket // CONNECT waiting for enhanced authentication
 	KeepaliveTimer uint16
 	Done           chan struct{}
 	stop           chan struct{}
+	kicked         int32 // set once kick has been called
 }
 
-var clients = make(map[string]*incomingConn)
-var clientsMu sync.Mutex
+// Sequence for the client ids assigned to clients that connect without one.
+var autoClientID uint64
 
 // newIncomingConn creates a new incomingConn associated with this
 // server. The connection becomes the property of the incomingConn
@@ -57,8 +67,9 @@ func (r receipt) waitTimeout(t time.Duration) {
 }
 
 type job struct {
-	m packets.ControlPacket
-	r receipt
+	m       packets.ControlPacket
+	r       receipt
+	expires time.Time // for a PUBLISH, when it expires; zero if never
 }
 
 // Start reading and writing on this connection.
@@ -67,83 +78,252 @@ func (c *incomingConn) start() {
 	go c.writer()
 }
 
-// Add this connection to the map, or find out that an existing connection
-// already exists for the same client-id.
-func (c *incomingConn) add() *incomingConn {
-	clientsMu.Lock()
-	defer clientsMu.Unlock()
+// Queue a message; no notification of sending is done. The message is
+// discarded if the connection is being torn down.
+func (c *incomingConn) submit(m packets.ControlPacket) {
+	c.submitJob(job{m: m})
+}
 
-	existing, ok := clients[c.clientid]
-	if !ok {
-		// this client id already exists, return it
-		return existing
+// Queue a job; no notification of sending is done. The job is discarded
+// if the connection is being torn down.
+func (c *incomingConn) submitJob(j job) {
+	select {
+	case c.jobs <- j:
+	case <-c.stop:
 	}
+	return
+}
 
-	clients[c.clientid] = c
-	return nil
+func (c *incomingConn) String() string {
+	return fmt.Sprintf("{IncomingConn: %v}", c.clientid)
 }
 
-// Delete a connection; the conection must be closed by the caller first.
-func (c *incomingConn) del() {
-	clientsMu.Lock()
-	defer clientsMu.Unlock()
-	delete(clients, c.clientid)
-	return
+// Queue a message, returns a channel that will be readable
+// when the message is sent. Should the queue stay full for the given
+// time, as it does for a client that stopped reading, the message is
+// dropped and the channel readable right away.
+func (c *incomingConn) submitSync(m packets.ControlPacket, timeout time.Duration) receipt {
+	j := job{m: m, r: make(receipt)}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case c.jobs <- j:
+	case <-c.stop:
+		close(j.r)
+	case <-t.C:
+		close(j.r)
+	}
+	return j.r
 }
 
-// Replace any existing connection with this one. The one to be replaced,
-// if any, must be closed first by the caller.
-func (c *incomingConn) replace() {
-	clientsMu.Lock()
-	defer clientsMu.Unlock()
+// Refuse the connection with the given CONNACK return code. The CONNACK
+// is flushed before returning, so that closing the connection afterwards
+// does not discard it. Before MQTT 5, protocol violations get no CONNACK
+// at all.
+func (c *incomingConn) refuse(rc byte) {
+	if rc > packets.ErrRefusedNotAuthorised && c.version != packets.Version5 {
+		return
+	}
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = c.returnCode(rc)
+	c.submitSync(connack, time.Second).waitTimeout(time.Second)
+}
 
-	// Check that any existing connection is already closed.
-	existing, ok := clients[c.clientid]
-	if ok {
-		die := false
-		select {
-		case _, ok := <-existing.jobs:
-			// what? we are expecting that this channel is closed!
-			if ok {
-				die = true
+// Refuse an MQTT 5 connection with the given CONNACK reason code.
+func (c *incomingConn) refuseReason(reason byte) {
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = reason
+	c.submitSync(connack, time.Second).waitTimeout(time.Second)
+}
+
+// Check the MQTT 5 subscription options of a SUBSCRIBE. It returns a
+// reason code other than ReasonSuccess for a protocol error: a Retain
+// Handling of 3, No Local on a shared subscription, or a Subscription
+// Identifier of 0.
+func checkOptions(m *packets.SubscribePacket) byte {
+	if m.Properties != nil {
+		for _, id := range m.Properties.SubscriptionIdentifier {
+			if id == 0 {
+				return packets.ReasonProtocolError
 			}
-		default:
-			die = true
 		}
-		if die {
-			panic("attempting to replace a connection that is not closed")
+	}
+	for i, o := range m.Options {
+		if o.RetainHandling > 2 {
+			return packets.ReasonProtocolError
 		}
+		if _, _, ok := parseShare(m.Topics[i]); ok && o.NoLocal {
+			return packets.ReasonProtocolError
+		}
+	}
+	return packets.ReasonSuccess
+}
 
-		delete(clients, c.clientid)
+// Tell an MQTT 5 client with a DISCONNECT why its connection is about to
+// be closed. Older clients are just disconnected. When the server is
+// shutting down or an administrator asks, the client is pointed to the
+// server's ServerReference, if set.
+func (c *incomingConn) disconnect(reason byte) {
+	if c.version != packets.Version5 {
+		return
+	}
+	d := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+	d.ReasonCode = reason
+	d.Properties = &packets.Properties{ReasonString: packets.ReasonCodes[reason]}
+	switch reason {
+	case packets.ReasonServerShuttingDown, packets.ReasonAdministrativeAction:
+		d.Properties.ServerReference = c.svr.ServerReference
 	}
+	c.submitSync(d, time.Second).waitTimeout(time.Second)
+}
 
-	clients[c.clientid] = c
-	return
+// Disconnect the client from outside its reader: tell it why, then close
+// the connection, which makes the reader exit. Only the first call has
+// any effect.
+func (c *incomingConn) kick(reason byte) {
+	if !atomic.CompareAndSwapInt32(&c.kicked, 0, 1) {
+		return
+	}
+	c.disconnect(reason)
+	c.conn.Close()
 }
 
-// Queue a message; no notification of sending is done.
-func (c *incomingConn) submit(m packets.ControlPacket) {
-	j := job{m: m}
-	c.jobs <- j
-	return
+// The properties of the CONNACK accepting an MQTT 5 client: what the
+// server supports, and the response information if the client asked for
+// it and the server has a ResponseInfoPrefix.
+func (c *incomingConn) connackProperties(m *packets.ConnectPacket) *packets.Properties {
+	p := &packets.Properties{}
+	p.ReceiveMaximum = packets.Uint16(c.svr.ReceiveMaximum)
+	if c.svr.MaxQoS < 2 {
+		p.MaximumQos = packets.Byte(c.svr.MaxQoS)
+	}
+	if c.svr.MaxPacketSize > 0 {
+		p.MaximumPacketSize = packets.Uint32(uint32(c.svr.MaxPacketSize))
+	}
+	if c.svr.TopicAliasMaximum > 0 {
+		p.TopicAliasMaximum = packets.Uint16(c.svr.TopicAliasMaximum)
+	}
+	if m.Properties != nil && m.Properties.RequestResponseInfo != nil && *m.Properties.RequestResponseInfo == 1 && c.svr.ResponseInfoPrefix != "" {
+		p.ResponseInfo = c.svr.ResponseInfoPrefix + c.clientid
+	}
+	return p
 }
 
-func (c *incomingConn) String() string {
-	return fmt.Sprintf("{IncomingConn: %v}", c.clientid)
+// Report whether a PUBLISH fits in the Maximum Packet Size of the
+// client, allowing for the topic alias that may be added on sending.
+func (c *incomingConn) fits(m *packets.PublishPacket) bool {
+	if c.maxPacketSize == 0 {
+		return true
+	}
+	m.SetVersion(c.version)
+	n := packets.Size(m)
+	if c.outAliases != nil {
+		n += 3
+	}
+	return n <= c.maxPacketSize
 }
 
-// Queue a message, returns a channel that will be readable
-// when the message is sent.
-func (c *incomingConn) submitSync(m packets.ControlPacket) receipt {
-	j := job{m: m, r: make(receipt)}
-	c.jobs <- j
-	return j.r
+// Translate a CONNACK return code to the protocol version of the client.
+func (c *incomingConn) returnCode(rc byte) byte {
+	if c.version == packets.Version5 {
+		return packets.ReasonCode(rc)
+	}
+	return rc
+}
+
+// The SUBACK return code for a refused subscription: the given reason
+// code for MQTT 5, the generic failure before.
+func (c *incomingConn) subackFailure(reason byte) byte {
+	if c.version == packets.Version5 {
+		return reason
+	}
+	return packets.SubackFailure
+}
+
+// Check with the server's Authorizer, if any, whether this connection
+// may access the topic.
+func (c *incomingConn) authorized(topic string, access Access) bool {
+	return c.svr.Authz == nil || c.svr.Authz.Authorize(c.connect, topic, access)
+}
+
+// Hand a message from this connection to the subscription workers. Messages
+// the Authorizer denies are dropped; the sender is still acknowledged.
+func (c *incomingConn) publish(m *packets.PublishPacket) {
+	if !c.authorized(m.TopicName, AccessWrite) {
+		log.Printf("INFO: Denied PUBLISH from %v to %v", c.clientid, m.TopicName)
+		c.svr.stats.messageDrop()
+		return
+	}
+	c.svr.subs.submit(c, m)
+}
+
+// Accept a client whose CONNECT has been validated and authenticated:
+// take over from any connection with the same client id, resume or
+// start its session, and send the CONNACK, along with the final data of
+// an enhanced authentication exchange, if any.
+func (c *incomingConn) accept(m *packets.ConnectPacket, authData []byte) {
+	c.clientid = m.ClientIdentifier
+	assigned := c.clientid == ""
+	if assigned {
+		c.clientid = fmt.Sprintf("auto-%d", atomic.AddUint64(&autoClientID, 1))
+		// The Authorizer knows the client by the id in its CONNECT.
+		m.ClientIdentifier = c.clientid
+	}
+	c.KeepaliveTimer = m.KeepaliveTimer
+	c.connect = m
+	if p := m.Properties; p != nil {
+		if p.TopicAliasMaximum != nil && *p.TopicAliasMaximum > 0 {
+			c.outAliases = newTopicAliases(*p.TopicAliasMaximum)
+		}
+		if p.ReceiveMaximum != nil {
+			c.receiveMax = *p.ReceiveMaximum
+		}
+		if p.MaximumPacketSize != nil {
+			c.maxPacketSize = int(*p.MaximumPacketSize)
+		}
+	}
+
+	// Disconnect existing connections.
+	if existing := c.svr.sessions.connect(c); existing != nil {
+		existing.kick(packets.ReasonSessionTakenOver)
+	}
+
+	sess, present := c.svr.sessions.get(c.clientid, m.CleanSession, sessionExpiry(m))
+	c.sess = sess
+
+	// connack
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = c.returnCode(packets.Accepted)
+	connack.SessionPresent = present && m.ProtocolVersion >= 4
+	if c.version == packets.Version5 {
+		connack.Properties = c.connackProperties(m)
+		if assigned {
+			connack.Properties.AssignedClientID = c.clientid
+		}
+		if c.authMethod != "" {
+			connack.Properties.AuthMethod = c.authMethod
+			connack.Properties.AuthData = authData
+		}
+	}
+	c.submit(connack)
+
+	// Resume the session, sending what was queued meanwhile.
+	sess.attach(c)
+	go c.retrier(sess)
+
+	// Log in mosquitto format.
+	clean := 0
+	if m.CleanSession {
+		clean = 1
+	}
+	log.Printf("INFO: New client connected from %v as %v (c%v, k%v).", c.conn.RemoteAddr(), c.clientid, clean, m.KeepaliveTimer)
 }
 
 func (c *incomingConn) reader() {
 	var err error
 	var zeroTime time.Time
 	var m packets.ControlPacket
+	var willed bool // MQTT 5 DISCONNECT asking for the will
 
 	for {
 		if c.KeepaliveTimer > 0 {
@@ -152,8 +332,13 @@ func (c *incomingConn) reader() {
 			c.conn.SetReadDeadline(zeroTime)
 		}
 
-		m, err = packets.ReadPacket(c.conn)
+		m, err = packets.ReadPacketMax(c.conn, c.version, c.svr.MaxPacketSize)
 		if err != nil {
+			if err == packets.ErrPacketTooLarge {
+				c.disconnect(packets.ReasonPacketTooLarge)
+			} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() && c.connect != nil {
+				c.disconnect(packets.ReasonKeepAliveTimeout)
+			}
 			break
 		}
 		c.svr.stats.messageRecv()
@@ -162,93 +347,199 @@ func (c *incomingConn) reader() {
 			log.Printf("INFO: dump  in: %T", m)
 		}
 
+		// The first packet of a connection must be a CONNECT, followed
+		// by AUTH packets only until enhanced authentication is done.
+		if _, ok := m.(*packets.ConnectPacket); !ok && c.connect == nil {
+			if _, ok := m.(*packets.AuthPacket); !ok || c.pending == nil {
+				err = fmt.Errorf("expected CONNECT, got %T", m)
+				goto exit
+			}
+		}
+
 		switch m := m.(type) {
 		case *packets.ConnectPacket:
+			if c.connect != nil || c.pending != nil {
+				// A client may only send one CONNECT.
+				err = fmt.Errorf("second CONNECT from %v", c.conn.RemoteAddr())
+				c.disconnect(packets.ReasonProtocolError)
+				goto exit
+			}
+			if m.ProtocolVersion == packets.Version5 {
+				c.version = packets.Version5
+			}
 			rc := m.Validate()
+			certified := false
+			if rc == packets.Accepted {
+				certified, rc = c.certIdentity(m)
+			}
+			if rc == packets.Accepted && m.ClientIdentifier == "" && !m.CleanSession && c.version != packets.Version5 {
+				// Before MQTT 5, only a clean session can do without a
+				// client id.
+				rc = packets.ErrRefusedIDRejected
+			}
+			if rc == packets.Accepted && c.version == packets.Version5 && m.Properties != nil && m.Properties.AuthMethod != "" {
+				if err = c.startAuth(m); err != nil {
+					log.Printf("ERROR: Connection refused for %v: %v", c.conn.RemoteAddr(), err)
+					goto exit
+				}
+				break
+			}
+			if rc == packets.Accepted && c.svr.Auth != nil && !certified {
+				rc = c.svr.Auth.Authenticate(c.conn.RemoteAddr(), m)
+			}
 			if rc != packets.Accepted {
 				err = packets.ConnErrors[rc]
 				log.Printf("ERROR: Connection refused for %v: %v", c.conn.RemoteAddr(), err)
+				c.refuse(rc)
 				goto exit
 			}
 
-			// TODO: authorize
-
-			// connack
-			connack := packets.NewControlPacket(packets.Connack)
-			connack.(*packets.ConnackPacket).ReturnCode = rc
-			c.submit(connack)
-
-			c.clientid = m.ClientIdentifier
-			c.KeepaliveTimer = m.KeepaliveTimer
-			c.connect = m
+			c.accept(m, nil)
 
-			// Disconnect existing connections.
-			if existing := c.add(); existing != nil {
-				disconnect := packets.NewControlPacket(packets.Disconnect)
-				r := existing.submitSync(disconnect)
-				r.waitTimeout(time.Second)
+		case *packets.PublishPacket:
+			if reason := c.resolveAlias(m); reason != packets.ReasonSuccess {
+				err = fmt.Errorf("invalid topic alias in PUBLISH from %v", c.clientid)
+				c.disconnect(reason)
+				goto exit
 			}
-			c.add()
-
-			// Log in mosquitto format.
-			clean := 0
-			if m.CleanSession {
-				clean = 1
+			if m.Properties != nil && strings.ContainsAny(m.Properties.ResponseTopic, "+#") {
+				err = fmt.Errorf("wildcard in response topic of PUBLISH from %v", c.clientid)
+				c.disconnect(packets.ReasonProtocolError)
+				goto exit
+			}
+			if c.version == packets.Version5 && m.Qos > c.svr.MaxQoS {
+				err = fmt.Errorf("PUBLISH from %v above the Maximum QoS", c.clientid)
+				c.disconnect(packets.ReasonQoSNotSupported)
+				goto exit
 			}
-			log.Printf("INFO: New client connected from %v as %v (c%v, k%v).", c.conn.RemoteAddr(), c.clientid, clean, m.KeepaliveTimer)
-
-		case *packets.PublishPacket:
 			switch m.Qos {
 			case 2:
+				if c.version == packets.Version5 && !c.sess.accepts(m.PacketID, int(c.svr.ReceiveMaximum)) {
+					err = fmt.Errorf("receive maximum exceeded by %v", c.clientid)
+					c.disconnect(packets.ReasonReceiveMaximumExceeded)
+					goto exit
+				}
 				pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
 				pr.PacketID = m.PacketID
 				c.submit(pr)
-				c.svr.subs.submit(c, m)
+				// Method B: the packet id is kept until PUBREL, so that a
+				// retransmitted PUBLISH is acknowledged but not passed on
+				// a second time.
+				if c.sess.receive(m.PacketID) {
+					c.publish(m)
+				}
 			case 1:
-				c.svr.subs.submit(c, m)
+				c.publish(m)
 
 				pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
 				pa.PacketID = m.PacketID
 				c.submit(pa)
 			case 0:
-				c.svr.subs.submit(c, m)
+				c.publish(m)
 			}
 		case *packets.PubackPacket:
+			c.sess.complete(m.PacketID)
 		case *packets.PubrecPacket:
+			c.sess.received(m.PacketID)
 			prel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
 			prel.PacketID = m.PacketID
 			c.submit(prel)
 		case *packets.PubrelPacket:
+			c.sess.release(m.PacketID)
 			pc := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
 			pc.PacketID = m.PacketID
 			c.submit(pc)
 		case *packets.PubcompPacket:
+			c.sess.complete(m.PacketID)
 		case *packets.PingreqPacket:
 			pr := packets.NewControlPacket(packets.Pingresp)
 			c.submit(pr)
 		case *packets.SubscribePacket:
-			for i := 0; i < len(m.Topics); i++ {
-				topic := m.Topics[i]
-				c.svr.subs.add(topic, c)
+			if reason := checkOptions(m); reason != packets.ReasonSuccess {
+				err = fmt.Errorf("invalid subscription options in SUBSCRIBE from %v", c.clientid)
+				c.disconnect(reason)
+				goto exit
 			}
-
 			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
 			suback.PacketID = m.PacketID
-			suback.GrantedQoss = m.Qoss
+			suback.GrantedQoss = make([]byte, len(m.Topics))
+			subs := make([]subscription, len(m.Topics))
+			existed := make([]bool, len(m.Topics))
+			var ids []int
+			if m.Properties != nil && len(m.Properties.SubscriptionIdentifier) > 0 {
+				ids = m.Properties.SubscriptionIdentifier[:1]
+			}
+			for i, topic := range m.Topics {
+				if !validFilter(topic) {
+					log.Printf("INFO: Invalid SUBSCRIBE from %v to %v", c.clientid, topic)
+					suback.GrantedQoss[i] = c.subackFailure(packets.ReasonTopicFilterInvalid)
+					continue
+				}
+				filter := topic
+				if _, f, ok := parseShare(topic); ok {
+					filter = f
+				}
+				if !c.authorized(filter, AccessRead) {
+					log.Printf("INFO: Denied SUBSCRIBE from %v to %v", c.clientid, topic)
+					suback.GrantedQoss[i] = c.subackFailure(packets.ReasonNotAuthorized)
+					continue
+				}
+				qos := m.Qoss[i]
+				if qos > c.svr.MaxQoS {
+					qos = c.svr.MaxQoS
+				}
+				subs[i] = subscription{s: c.sess, qos: qos, ids: ids}
+				if i < len(m.Options) {
+					subs[i].opts = m.Options[i]
+				}
+				existed[i] = c.sess.subscribe(topic, subs[i])
+				c.svr.subs.add(topic, subs[i])
+				suback.GrantedQoss[i] = qos
+			}
 			c.submit(suback)
 
-			for _, topic := range m.Topics {
-				c.svr.subs.sendRetain(topic, c)
+			for i, topic := range m.Topics {
+				// Shared subscriptions get no retained messages.
+				if _, _, ok := parseShare(topic); ok {
+					continue
+				}
+				if suback.GrantedQoss[i] < packets.SubackFailure {
+					c.svr.subs.sendRetain(topic, subs[i], existed[i])
+				}
 			}
 		case *packets.UnsubscribePacket:
 			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
 			unsuback.PacketID = m.PacketID
 			for _, t := range m.Topics {
-				c.svr.subs.unsub(t, c)
+				reason := byte(packets.ReasonSuccess)
+				if c.sess.unsubscribe(t) {
+					c.svr.subs.unsub(t, c.sess)
+				} else {
+					reason = packets.ReasonNoSubscriptionExisted
+				}
+				unsuback.ReasonCodes = append(unsuback.ReasonCodes, reason)
 			}
 			c.submit(unsuback)
 
+		case *packets.AuthPacket:
+			if err = c.handleAuth(m); err != nil {
+				log.Printf("ERROR: Authentication failed for %v: %v", c.conn.RemoteAddr(), err)
+				goto exit
+			}
 		case *packets.DisconnectPacket:
+			if c.version == packets.Version5 {
+				if p := m.Properties; p != nil && p.SessionExpiryInterval != nil {
+					// A session that was to end with the connection
+					// cannot be kept at the last moment.
+					if sessionExpiry(c.connect) == 0 && *p.SessionExpiryInterval != 0 {
+						err = fmt.Errorf("session expiry set at DISCONNECT by %v", c.clientid)
+						c.disconnect(packets.ReasonProtocolError)
+						goto exit
+					}
+					c.sess.setExpiry(*p.SessionExpiryInterval)
+				}
+				willed = m.ReasonCode == packets.ReasonDisconnectWithWill
+			}
 			goto exit
 		default:
 			err = fmt.Errorf("unknown msg type %T", m)
@@ -257,49 +548,128 @@ func (c *incomingConn) reader() {
 	}
 
 exit:
-	if err != nil {
-		if err != io.EOF && !strings.Contains(err.Error(), "use of closed") {
-			log.Printf("ERROR: failed to reader - %s", err)
-		}
-
-		if c.connect.WillFlag {
-			pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
-			pub.Qos = c.connect.WillQos
-			pub.Retain = c.connect.WillRetain
-			pub.TopicName = c.connect.WillTopic
-			pub.Payload = c.connect.WillMessage
-			c.svr.subs.submit(c, pub)
-		}
+	var will *packets.PublishPacket
+	if err != nil && err != io.EOF && !strings.Contains(err.Error(), "use of closed") {
+		log.Printf("ERROR: failed to reader - %s", err)
+	}
+	if (err != nil || willed) && c.connect != nil && c.connect.WillFlag {
+		will = packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		will.Qos = c.connect.WillQos
+		will.Retain = c.connect.WillRetain
+		will.TopicName = c.connect.WillTopic
+		will.Payload = c.connect.WillMessage
+		will.Properties = messageProperties(c.connect.WillProperties)
 	}
 
-	c.del()
-	c.svr.subs.unsubAll(c)
-	c.svr.stats.clientDisconnect()
 	c.conn.Close()
 	close(c.stop)
+	c.svr.sessions.disconnect(c)
+	if c.sess != nil {
+		// The session decides when the will is published.
+		c.svr.sessions.release(c, will)
+	}
+	c.svr.stats.clientDisconnect()
+}
+
+// Periodically send again the messages of the session that wait for an
+// acknowledgement for longer than the server's RetryInterval.
+func (c *incomingConn) retrier(sess *session) {
+	if c.svr.RetryInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.svr.RetryInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sess.resend(c, c.svr.RetryInterval)
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Prepare the packet of a job for sending. An expired PUBLISH is dropped,
+// and false returned. For MQTT 5, a PUBLISH is sent as a copy carrying
+// what is left of its lifetime and a topic alias, since the session keeps
+// the original to send it again.
+func (c *incomingConn) prepare(j job) (packets.ControlPacket, bool) {
+	m, ok := j.m.(*packets.PublishPacket)
+	if !ok {
+		return j.m, true
+	}
+	left := time.Until(j.expires)
+	if !j.expires.IsZero() && left <= 0 {
+		c.svr.stats.messageDrop()
+		return nil, false
+	}
+	if c.version != packets.Version5 || j.expires.IsZero() && c.outAliases == nil {
+		return m, true
+	}
+
+	p := copyPublish(m)
+	p.PacketID = m.PacketID
+	p.Dup = m.Dup
+	if p.Properties == nil {
+		p.Properties = &packets.Properties{}
+	}
+	if !j.expires.IsZero() {
+		secs := uint32((left + time.Second - 1) / time.Second)
+		p.Properties.MessageExpiry = packets.Uint32(secs)
+	}
+	if c.outAliases != nil {
+		alias, known := c.outAliases.get(p.TopicName)
+		p.Properties.TopicAlias = packets.Uint16(alias)
+		if known {
+			p.TopicName = ""
+		}
+	}
+	return p, true
 }
 
 func (c *incomingConn) writer() {
 	var err error
+	var pending []job // to send before the jobs queued in c.jobs
 
 	for {
-		select {
-		case job := <-c.jobs:
-			err = job.m.WriteTo(c.conn)
+		var job job
+		if len(pending) > 0 {
+			job, pending = pending[0], pending[1:]
+		} else {
+			select {
+			case job = <-c.jobs:
+			case <-c.stop:
+				goto exit
+			}
+		}
+
+		m, ok := c.prepare(job)
+		if !ok {
 			if job.r != nil {
 				close(job.r)
 			}
-			if err != nil {
-				goto exit
+			// An expired QoS 1 or 2 message leaves room in flight for
+			// those queued after it.
+			if p := job.m.(*packets.PublishPacket); p.Qos > 0 {
+				pending = append(pending, c.sess.expireInflight(c, p.PacketID)...)
 			}
-			if _, ok := job.m.(*packets.DisconnectPacket); ok {
-				goto exit
-			}
-			c.svr.stats.messageSend()
-		case <-c.stop:
+			continue
+		}
+		m.SetVersion(c.version)
+		err = m.WriteTo(c.conn)
+		if job.r != nil {
+			close(job.r)
+		}
+		if err != nil {
+			goto exit
+		}
+		if _, ok := m.(*packets.DisconnectPacket); ok {
 			goto exit
 		}
+		c.svr.stats.messageSend()
 	}
 
 exit:
+	// Wake up the reader, should it still be waiting for a packet.
+	c.conn.Close()
 }
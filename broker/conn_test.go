@@ -0,0 +1,212 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+// newTestServer starts a Server on a local port, set up by setup if not
+// nil, and stops it when the test is done.
+func newTestServer(t *testing.T, setup func(*Server)) *Server {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(l)
+	if setup != nil {
+		setup(s)
+	}
+	s.Start()
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// A testClient speaks MQTT to a Server, one packet at a time.
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	version byte
+}
+
+// connectConn sends a CONNECT on a connection, and returns the client
+// with the CONNACK, or nil if there was none.
+func connectConn(t *testing.T, conn net.Conn, m *packets.ConnectPacket) (*testClient, *packets.ConnackPacket) {
+	t.Helper()
+	if m.ProtocolName == "" {
+		m.ProtocolName, m.ProtocolVersion = "MQTT", 4
+	}
+	c := &testClient{t: t, conn: conn, version: m.ProtocolVersion}
+	t.Cleanup(func() { conn.Close() })
+	c.send(m)
+	connack, _ := c.read(2 * time.Second).(*packets.ConnackPacket)
+	return c, connack
+}
+
+// connectTo connects a client to the first listener of a Server.
+func connectTo(t *testing.T, s *Server, m *packets.ConnectPacket) (*testClient, *packets.ConnackPacket) {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return connectConn(t, conn, m)
+}
+
+func newConnect(clientid string, clean bool) *packets.ConnectPacket {
+	m := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	m.ProtocolName, m.ProtocolVersion = "MQTT", 4
+	m.ClientIdentifier = clientid
+	m.CleanSession = clean
+	return m
+}
+
+func (c *testClient) send(m packets.ControlPacket) {
+	c.t.Helper()
+	m.SetVersion(c.version)
+	if err := m.WriteTo(c.conn); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read returns the next packet, or nil if none comes in time or the
+// connection is closed.
+func (c *testClient) read(timeout time.Duration) packets.ControlPacket {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	m, err := packets.ReadPacketVersion(c.conn, c.version)
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+// readPublish returns the next PUBLISH, or nil if none comes in time.
+func (c *testClient) readPublish(timeout time.Duration) *packets.PublishPacket {
+	for {
+		m := c.read(timeout)
+		if m == nil {
+			return nil
+		}
+		if p, ok := m.(*packets.PublishPacket); ok {
+			return p
+		}
+	}
+}
+
+func (c *testClient) subscribe(id uint16, filter string, qos byte) {
+	c.t.Helper()
+	m := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	m.PacketID = id
+	m.Topics = []string{filter}
+	m.Qoss = []byte{qos}
+	c.send(m)
+	if _, ok := c.read(2 * time.Second).(*packets.SubackPacket); !ok {
+		c.t.Fatalf("no SUBACK for %s", filter)
+	}
+}
+
+func newPublish(id uint16, topic string, qos byte, payload string) *packets.PublishPacket {
+	m := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	m.PacketID = id
+	m.Qos = qos
+	m.TopicName = topic
+	m.Payload = []byte(payload)
+	return m
+}
+
+func TestSecondConnect(t *testing.T) {
+	s := newTestServer(t, nil)
+	c, connack := connectTo(t, s, newConnect("twice", true))
+	if connack == nil || connack.ReturnCode != packets.Accepted {
+		t.Fatalf("first CONNECT refused: %v", connack)
+	}
+	c.send(newConnect("twice", true))
+	if m := c.read(2 * time.Second); m != nil {
+		t.Fatalf("got %T after a second CONNECT, want the connection closed", m)
+	}
+
+	// The same with MQTT 5, which is told why.
+	m := newConnect("twice5", true)
+	m.ProtocolVersion = packets.Version5
+	c, connack = connectTo(t, s, m)
+	if connack == nil || connack.ReturnCode != packets.Accepted {
+		t.Fatalf("first CONNECT refused: %v", connack)
+	}
+	m = newConnect("twice5", true)
+	m.ProtocolVersion = packets.Version5
+	c.send(m)
+	d, ok := c.read(2 * time.Second).(*packets.DisconnectPacket)
+	if !ok || d.ReasonCode != packets.ReasonProtocolError {
+		t.Fatalf("got %v, want a DISCONNECT with a protocol error", d)
+	}
+	if m := c.read(2 * time.Second); m != nil {
+		t.Fatalf("got %T, want the connection closed", m)
+	}
+}
+
+func TestKickSlowConsumer(t *testing.T) {
+	s := newTestServer(t, nil)
+	conn, err := net.Dial("tcp", s.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).SetReadBuffer(4096)
+	m := newConnect("slow", true)
+	m.ProtocolVersion = packets.Version5
+	slow, _ := connectConn(t, conn, m)
+	slow.subscribe(1, "flood", 0)
+
+	// The client stops reading: its writer gets stuck, then its queue
+	// fills up.
+	pub, _ := connectTo(t, s, newConnect("pub", true))
+	go func() {
+		payload := string(make([]byte, 256<<10))
+		for i := 0; i < 200; i++ {
+			if err := newPublish(0, "flood", 0, payload).WriteTo(pub.conn); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(time.Second)
+
+	done := make(chan bool)
+	go func() { done <- s.Kick("slow") }()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal("client not connected")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Kick stuck on a client that does not read")
+	}
+}
+
+func TestAssignedClientID(t *testing.T) {
+	s := newTestServer(t, nil)
+	for _, clean := range []bool{true, false} {
+		m := newConnect("", clean)
+		m.ProtocolVersion = packets.Version5
+		_, connack := connectTo(t, s, m)
+		if connack == nil || connack.ReturnCode != packets.Accepted {
+			t.Fatalf("clean %v: got %v, want the CONNECT accepted", clean, connack)
+		}
+		if connack.Properties == nil || connack.Properties.AssignedClientID == "" {
+			t.Fatalf("clean %v: no assigned client id", clean)
+		}
+	}
+
+	// A client id of its own is not assigned again.
+	m := newConnect("mine", true)
+	m.ProtocolVersion = packets.Version5
+	if _, connack := connectTo(t, s, m); connack == nil || connack.Properties.AssignedClientID != "" {
+		t.Fatalf("got %v, want no assigned client id", connack)
+	}
+
+	// Before MQTT 5, a session kept without a client id is refused.
+	if _, connack := connectTo(t, s, newConnect("", false)); connack == nil || connack.ReturnCode != packets.ErrRefusedIDRejected {
+		t.Fatalf("got %v, want the client id rejected", connack)
+	}
+}
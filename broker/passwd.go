@@ -0,0 +1,175 @@
+package broker
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+// A PasswordFile is an Authenticator backed by a mosquitto password file.
+// Each line holds "username:hash", where hash is either $6$salt$hash
+// (SHA-512 of password and salt) or $7$iterations$salt$hash
+// (PBKDF2-SHA512), with salt and hash base64 encoded, as written by
+// mosquitto_passwd. Hashes of other kinds, such as bcrypt, cannot be
+// checked: a file holding one fails to load.
+type PasswordFile struct {
+	// When true, clients that do not send a username are let in.
+	AllowAnonymous bool
+
+	path  string
+	mu    sync.RWMutex
+	users map[string]passwordHash
+}
+
+// A passwordHash is a password hash from a mosquitto password file.
+type passwordHash struct {
+	iter int // PBKDF2-SHA512 iterations for $7$, 0 for $6$
+	salt []byte
+	sum  []byte
+}
+
+// NewPasswordFile loads the password file at path.
+func NewPasswordFile(path string) (*PasswordFile, error) {
+	p := &PasswordFile{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload rereads the password file. On error the previous contents are
+// kept.
+func (p *PasswordFile) Reload() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string]passwordHash)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, ":")
+		if i < 0 {
+			return fmt.Errorf("%s:%d: missing password hash", p.path, n)
+		}
+		h, err := parsePasswordHash(line[i+1:])
+		if err != nil {
+			return fmt.Errorf("%s:%d: user %s: %s", p.path, n, line[:i], err)
+		}
+		users[line[:i]] = h
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.users = users
+	p.mu.Unlock()
+	return nil
+}
+
+// Authenticate implements Authenticator.
+func (p *PasswordFile) Authenticate(addr net.Addr, m *packets.ConnectPacket) byte {
+	if !m.UsernameFlag {
+		if p.AllowAnonymous {
+			return packets.Accepted
+		}
+		return packets.ErrRefusedNotAuthorised
+	}
+
+	p.mu.RLock()
+	entry, ok := p.users[m.Username]
+	p.mu.RUnlock()
+	if !ok || !entry.check(m.Password) {
+		return packets.ErrRefusedBadUsernameOrPassword
+	}
+	return packets.Accepted
+}
+
+// parsePasswordHash reads a mosquitto password hash.
+func parsePasswordHash(entry string) (passwordHash, error) {
+	parts := strings.Split(entry, "$")
+	if len(parts) < 3 || parts[0] != "" {
+		return passwordHash{}, errors.New("not a password hash")
+	}
+
+	var h passwordHash
+	var err error
+	switch {
+	case parts[1] == "6" && len(parts) == 4:
+		h.salt, err = base64.StdEncoding.DecodeString(parts[2])
+	case parts[1] == "7" && len(parts) == 5:
+		h.iter, err = strconv.Atoi(parts[2])
+		if err == nil && h.iter <= 0 {
+			err = errors.New("bad iteration count")
+		}
+		if err == nil {
+			h.salt, err = base64.StdEncoding.DecodeString(parts[3])
+		}
+	case parts[1] == "2a" || parts[1] == "2b" || parts[1] == "2y":
+		return passwordHash{}, errors.New("bcrypt hashes are not supported, use mosquitto_passwd")
+	default:
+		return passwordHash{}, fmt.Errorf("unsupported hash type $%s$", parts[1])
+	}
+	if err == nil {
+		h.sum, err = base64.StdEncoding.DecodeString(parts[len(parts)-1])
+	}
+	if err != nil {
+		return passwordHash{}, err
+	}
+	return h, nil
+}
+
+// check compares a password with the hash.
+func (h passwordHash) check(password []byte) bool {
+	var sum []byte
+	if h.iter == 0 {
+		d := sha512.New()
+		d.Write(password)
+		d.Write(h.salt)
+		sum = d.Sum(nil)
+	} else {
+		sum = pbkdf2(password, h.salt, h.iter, sha512.Size, sha512.New)
+	}
+	return subtle.ConstantTimeCompare(sum, h.sum) == 1
+}
+
+// pbkdf2 derives a key from a password as described in RFC 8018.
+func pbkdf2(password, salt []byte, iter, keyLen int, h func() hash.Hash) []byte {
+	prf := hmac.New(h, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+func sha512Entry(password, salt string) string {
+	h := sha512.Sum512([]byte(password + salt))
+	b64 := base64.StdEncoding.EncodeToString
+	return "$6$" + b64([]byte(salt)) + "$" + b64(h[:])
+}
+
+func pbkdf2Entry(password, salt string, iter int) string {
+	sum := pbkdf2([]byte(password), []byte(salt), iter, sha512.Size, sha512.New)
+	b64 := base64.StdEncoding.EncodeToString
+	return "$7$" + strconv.Itoa(iter) + "$" + b64([]byte(salt)) + "$" + b64(sum)
+}
+
+func TestPasswordFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwd")
+	content := "# users\n" +
+		"alice:" + sha512Entry("secret", "salt1") + "\n" +
+		"bob:" + pbkdf2Entry("hunter2", "salt2", 101) + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user, password string
+		want           byte
+	}{
+		{"alice", "secret", packets.Accepted},
+		{"alice", "wrong", packets.ErrRefusedBadUsernameOrPassword},
+		{"bob", "hunter2", packets.Accepted},
+		{"bob", "secret", packets.ErrRefusedBadUsernameOrPassword},
+		{"dave", "secret", packets.ErrRefusedBadUsernameOrPassword},
+	}
+	for _, tt := range tests {
+		m := &packets.ConnectPacket{Username: tt.user, UsernameFlag: true, Password: []byte(tt.password), PasswordFlag: true}
+		if got := p.Authenticate(nil, m); got != tt.want {
+			t.Errorf("%s/%s: got %#x, want %#x", tt.user, tt.password, got, tt.want)
+		}
+	}
+	if got := p.Authenticate(nil, &packets.ConnectPacket{}); got != packets.ErrRefusedNotAuthorised {
+		t.Errorf("anonymous: got %#x", got)
+	}
+
+	// A hash that cannot be checked fails the load, rather than leaving
+	// its user out unnoticed; a failed Reload keeps the users loaded before.
+	bcrypt := content + "carol:$2b$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy\n"
+	if err := os.WriteFile(path, []byte(bcrypt), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Reload(); err == nil || !strings.Contains(err.Error(), "carol") {
+		t.Fatalf("Reload: got %v, want an error for carol", err)
+	}
+	m := &packets.ConnectPacket{Username: "alice", UsernameFlag: true, Password: []byte("secret"), PasswordFlag: true}
+	if got := p.Authenticate(nil, m); got != packets.Accepted {
+		t.Errorf("alice refused after a failed Reload: %#x", got)
+	}
+	if _, err := NewPasswordFile(path); err == nil {
+		t.Fatal("NewPasswordFile: no error for a bcrypt hash")
+	}
+}
+
+func TestParsePasswordHash(t *testing.T) {
+	for _, entry := range []string{
+		"",
+		"plain",
+		"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+		"$2y$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+		"$5$c2FsdA==$aGFzaA==",
+		"$7$0$c2FsdA==$aGFzaA==",
+		"$6$!!!$aGFzaA==",
+	} {
+		if _, err := parsePasswordHash(entry); err == nil {
+			t.Errorf("%q: no error", entry)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+// A Retained is a retained message, as a RetainStore keeps it.
+type Retained struct {
+	// The message, with its Retain flag set. It must not be modified once
+	// stored.
+	Message *packets.PublishPacket
+
+	// When the message expires, from its MQTT 5 Message Expiry Interval.
+	// Zero if it never does.
+	Expires time.Time
+}
+
+// A RetainStore keeps the last retained message of each topic.
+type RetainStore interface {
+	// Put stores a retained message, replacing the one of the same topic.
+	Put(r Retained) error
+
+	// Delete removes the retained message of a topic, if there is one.
+	Delete(topic string) error
+
+	// Match returns the retained messages whose topic matches a topic
+	// filter, which may hold wildcards.
+	Match(filter string) ([]Retained, error)
+
+	// Iterate calls f for each retained message, until f returns false.
+	// The store must not be modified from f.
+	Iterate(f func(Retained) bool) error
+}
+
+// A MemoryRetainStore is a RetainStore that keeps retained messages in
+// RAM, as part of the Store made by NewMemoryStore.
+type MemoryRetainStore struct {
+	mu     sync.RWMutex
+	retain map[string]Retained
+	tree   *retainTrie // the same messages, for wildcard filters
+}
+
+// NewMemoryRetainStore returns an empty MemoryRetainStore.
+func NewMemoryRetainStore() *MemoryRetainStore {
+	return &MemoryRetainStore{retain: make(map[string]Retained), tree: newRetainTrie()}
+}
+
+// Put stores a retained message.
+func (s *MemoryRetainStore) Put(r Retained) error {
+	s.mu.Lock()
+	s.retain[r.Message.TopicName] = r
+	s.tree.put(r)
+	s.mu.Unlock()
+	return nil
+}
+
+// Delete removes the retained message of a topic.
+func (s *MemoryRetainStore) Delete(topic string) error {
+	s.mu.Lock()
+	if _, ok := s.retain[topic]; ok {
+		delete(s.retain, topic)
+		s.tree.delete(topic)
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// Match returns the retained messages matching a topic filter.
+func (s *MemoryRetainStore) Match(filter string) ([]Retained, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !isWildcard(filter) {
+		if r, ok := s.retain[filter]; ok {
+			return []Retained{r}, nil
+		}
+		return nil, nil
+	}
+	return s.tree.match(filter), nil
+}
+
+// Iterate calls f for each retained message.
+func (s *MemoryRetainStore) Iterate(f func(Retained) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, r := range s.retain {
+		if !f(r) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryRetainStore) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.retain)
+}
+
+// A DiskRetainStore is a RetainStore that survives restarts. Retained
+// messages are kept in RAM, and every change is appended to a log file,
+// which is replayed when the store is opened. Once the log holds more
+// replaced and deleted messages than live ones, it is compacted: rewritten
+// with the live messages only.
+//
+// Writes are not synced to disk as they happen, so the last changes before
+// an operating system crash may be lost; those before a crash of the
+// process are not.
+//
+// The log starts with the 8 bytes "MQTTRET1". Then each record is an
+// operation byte, the length of the rest of the record as a big-endian
+// uint32, and:
+//
+//	'P' (put):    the expiry time as big-endian int64 Unix nanoseconds, 0
+//	              for never, followed by the message as an MQTT 5 PUBLISH
+//	'D' (delete): the topic
+type DiskRetainStore struct {
+	mem *MemoryRetainStore
+
+	path string
+	mu   sync.Mutex // guards the fields below
+	f    *os.File
+	dead int // records in the log that no longer count
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+var retainMagic = []byte("MQTTRET1")
+
+const (
+	retainPut    = 'P'
+	retainDelete = 'D'
+)
+
+// How often a DiskRetainStore checks whether its log needs compacting.
+const retainCompactInterval = time.Minute
+
+// OpenDiskRetainStore opens the retained message log at path, creating it
+// if it does not exist, and loads the messages it holds. A record cut
+// short by a crash at the end of the log is dropped.
+func OpenDiskRetainStore(path string) (*DiskRetainStore, error) {
+	s := &DiskRetainStore{
+		mem:  NewMemoryRetainStore(),
+		path: path,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	go s.compactor()
+	return s, nil
+}
+
+// Replay the log into memory, and leave it open for appending.
+func (s *DiskRetainStore) load() error {
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(retainMagic))
+	n, err := io.ReadFull(r, magic)
+	switch {
+	case n == 0 && err == io.EOF:
+		// a new log
+		if _, err := f.Write(retainMagic); err != nil {
+			f.Close()
+			return err
+		}
+	case err != nil || !bytes.Equal(magic, retainMagic):
+		f.Close()
+		return fmt.Errorf("%s: not a retained message log", s.path)
+	default:
+		good, err := s.replay(r)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("%s: %s", s.path, err)
+		}
+		if err := f.Truncate(good); err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := f.Seek(good, io.SeekStart); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	s.f = f
+	return nil
+}
+
+// Apply the records of the log to memory. It returns the offset of the end
+// of the last complete record.
+func (s *DiskRetainStore) replay(r io.Reader) (int64, error) {
+	good := int64(len(retainMagic))
+	var head [5]byte
+	for {
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return good, nil
+		}
+		n := binary.BigEndian.Uint32(head[1:])
+		if n > walRecordMax {
+			// No record is that large: the header was torn or garbled.
+			log.Printf("NOTICE: dropped the end of %s - record too large", s.path)
+			return good, nil
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return good, nil
+		}
+
+		switch head[0] {
+		case retainPut:
+			rec, err := decodeRetained(body)
+			if err != nil {
+				return 0, fmt.Errorf("bad record at offset %d - %s", good, err)
+			}
+			if s.has(rec.Message.TopicName) {
+				s.dead++
+			}
+			s.mem.Put(rec)
+		case retainDelete:
+			if s.has(string(body)) {
+				s.dead++
+			}
+			s.dead++
+			s.mem.Delete(string(body))
+		default:
+			return 0, fmt.Errorf("bad record at offset %d", good)
+		}
+		good += int64(len(head) + len(body))
+	}
+}
+
+func (s *DiskRetainStore) has(topic string) bool {
+	s.mem.mu.RLock()
+	_, ok := s.mem.retain[topic]
+	s.mem.mu.RUnlock()
+	return ok
+}
+
+func encodeRetained(r Retained) ([]byte, error) {
+	var b bytes.Buffer
+	var expires int64
+	if !r.Expires.IsZero() {
+		expires = r.Expires.UnixNano()
+	}
+	binary.Write(&b, binary.BigEndian, expires)
+	if err := writePublish(&b, r.Message); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func decodeRetained(body []byte) (Retained, error) {
+	if len(body) < 8 {
+		return Retained{}, errors.New("short record")
+	}
+	var r Retained
+	if expires := int64(binary.BigEndian.Uint64(body)); expires != 0 {
+		r.Expires = time.Unix(0, expires)
+	}
+	m, err := readPublish(body[8:])
+	if err != nil {
+		return Retained{}, err
+	}
+	r.Message = m
+	return r, nil
+}
+
+func appendRecord(w io.Writer, op byte, body []byte) error {
+	rec := make([]byte, 5, 5+len(body))
+	rec[0] = op
+	binary.BigEndian.PutUint32(rec[1:], uint32(len(body)))
+	_, err := w.Write(append(rec, body...))
+	return err
+}
+
+// Put stores a retained message.
+func (s *DiskRetainStore) Put(r Retained) error {
+	body, err := encodeRetained(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	if err := appendRecord(s.f, retainPut, body); err != nil {
+		return err
+	}
+	if s.has(r.Message.TopicName) {
+		s.dead++
+	}
+	return s.mem.Put(r)
+}
+
+// Delete removes the retained message of a topic.
+func (s *DiskRetainStore) Delete(topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	if !s.has(topic) {
+		return nil
+	}
+	if err := appendRecord(s.f, retainDelete, []byte(topic)); err != nil {
+		return err
+	}
+	// both the delete and the put before it are dead
+	s.dead += 2
+	return s.mem.Delete(topic)
+}
+
+// Match returns the retained messages matching a topic filter.
+func (s *DiskRetainStore) Match(filter string) ([]Retained, error) {
+	return s.mem.Match(filter)
+}
+
+// Iterate calls f for each retained message.
+func (s *DiskRetainStore) Iterate(f func(Retained) bool) error {
+	return s.mem.Iterate(f)
+}
+
+// Compact rewrites the log with the live retained messages only. The new
+// log replaces the old one once it has been synced to disk.
+func (s *DiskRetainStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	return s.compact()
+}
+
+func (s *DiskRetainStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.Write(retainMagic)
+	s.mem.Iterate(func(r Retained) bool {
+		var body []byte
+		body, err = encodeRetained(r)
+		if err == nil {
+			err = appendRecord(w, retainPut, body)
+		}
+		return err == nil
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	s.f.Close()
+	s.f = f
+	s.dead = 0
+	_, err = f.Seek(0, io.SeekEnd)
+	return err
+}
+
+// Compact the log from time to time, once it is mostly dead records.
+func (s *DiskRetainStore) compactor() {
+	defer close(s.done)
+	ticker := time.NewTicker(retainCompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.f != nil && s.dead > 0 && s.dead >= s.mem.len() {
+				if err := s.compact(); err != nil {
+					log.Printf("ERROR: failed to compact %s - %s", s.path, err)
+				}
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close syncs the log to disk and closes it.
+func (s *DiskRetainStore) Close() error {
+	s.mu.Lock()
+	f := s.f
+	s.f = nil
+	s.mu.Unlock()
+	if f == nil {
+		return os.ErrClosed
+	}
+	close(s.stop)
+	<-s.done
+
+	err := f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
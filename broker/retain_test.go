@@ -0,0 +1,48 @@
+package broker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskRetainStoreBadTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retained")
+	s, err := OpenDiskRetainStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newPublish(0, "status", 0, "up")
+	m.Retain = true
+	s.Put(Retained{Message: m})
+	s.Close()
+
+	// A header torn by a crash claims a record of 4 GB.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{retainPut, 0xFF, 0xFF, 0xFF, 0xFF, 1, 2})
+	f.Close()
+
+	s, err = OpenDiskRetainStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Match("status"); len(got) != 1 || string(got[0].Message.Payload) != "up" {
+		t.Fatalf("got %v after reopening, want the retained message", got)
+	}
+	// The bad tail is cut off, so what comes after it is kept.
+	m = newPublish(0, "other", 0, "x")
+	m.Retain = true
+	s.Put(Retained{Message: m})
+	s.Close()
+	s, err = OpenDiskRetainStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got, _ := s.Match("#"); len(got) != 2 {
+		t.Fatalf("got %d retained messages, want 2", len(got))
+	}
+}
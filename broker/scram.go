@@ -0,0 +1,303 @@
+package broker
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+// The number of PBKDF2 iterations of the credentials made by
+// NewScramCredential, as recommended by RFC 7677.
+const scramIterations = 4096
+
+// A ScramCredential is what the server keeps of the password of a SCRAM
+// user: the salt and iteration count used to derive keys from it, and
+// two of those keys. The password itself cannot be recovered from them.
+type ScramCredential struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramCredential derives the SCRAM-SHA-256 credential of a password,
+// with a random salt.
+func NewScramCredential(password string) (ScramCredential, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return ScramCredential{}, err
+	}
+	return scramCredential(password, salt, scramIterations), nil
+}
+
+func scramCredential(password string, salt []byte, iter int) ScramCredential {
+	salted := pbkdf2([]byte(password), salt, iter, sha256.Size, sha256.New)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	return ScramCredential{
+		Salt:       salt,
+		Iterations: iter,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSHA256(salted, []byte("Server Key")),
+	}
+}
+
+// String formats the credential as in a SCRAM file, without the user
+// name: "salt:iterations:storedkey:serverkey", base64 encoded.
+func (c ScramCredential) String() string {
+	b64 := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("%s:%d:%s:%s", b64(c.Salt), c.Iterations, b64(c.StoredKey), b64(c.ServerKey))
+}
+
+func parseScramCredential(s string) (ScramCredential, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 4 {
+		return ScramCredential{}, errors.New("expected salt:iterations:storedkey:serverkey")
+	}
+	var c ScramCredential
+	var err error
+	if c.Salt, err = base64.StdEncoding.DecodeString(parts[0]); err != nil {
+		return c, err
+	}
+	if c.Iterations, err = strconv.Atoi(parts[1]); err != nil || c.Iterations <= 0 {
+		return c, errors.New("bad iteration count")
+	}
+	if c.StoredKey, err = base64.StdEncoding.DecodeString(parts[2]); err != nil {
+		return c, err
+	}
+	if c.ServerKey, err = base64.StdEncoding.DecodeString(parts[3]); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// ScramSHA256 is the SCRAM-SHA-256 AuthMethod of RFC 7677, checking
+// clients against a local credential store. The store is either filled
+// with AddUser, or loaded from a file where each line holds
+// "username:credential", the credential formatted as by
+// ScramCredential.String.
+type ScramSHA256 struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]ScramCredential
+
+	secretOnce sync.Once
+	secret     []byte // keys the salts made up for unknown users
+}
+
+// NewScramSHA256 returns a SCRAM-SHA-256 method with no users.
+func NewScramSHA256() *ScramSHA256 {
+	return &ScramSHA256{users: make(map[string]ScramCredential)}
+}
+
+// NewScramSHA256File returns a SCRAM-SHA-256 method with the users of
+// the file at path.
+func NewScramSHA256File(path string) (*ScramSHA256, error) {
+	s := &ScramSHA256{path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// AddUser adds a user, or changes the password of an existing one.
+func (s *ScramSHA256) AddUser(username, password string) error {
+	c, err := NewScramCredential(password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.users[username] = c
+	s.mu.Unlock()
+	return nil
+}
+
+// Reload rereads the file of users, if any. On error the previous users
+// are kept.
+func (s *ScramSHA256) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string]ScramCredential)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return fmt.Errorf("%s:%d: missing credential", s.path, n)
+		}
+		c, err := parseScramCredential(line[i+1:])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", s.path, n, err)
+		}
+		users[line[:i]] = c
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.users = users
+	s.mu.Unlock()
+	return nil
+}
+
+// Name implements AuthMethod.
+func (s *ScramSHA256) Name() string {
+	return "SCRAM-SHA-256"
+}
+
+// Start implements AuthMethod.
+func (s *ScramSHA256) Start(m *packets.ConnectPacket) AuthExchange {
+	return &scramExchange{method: s}
+}
+
+var errScram = errors.New("SCRAM authentication failed")
+
+// A scramExchange goes through the two round trips of SCRAM: the client
+// sends its user name and nonce, the server answers with the salt,
+// iteration count and its own nonce; the client then sends its proof of
+// knowing the password, and the server answers with its own proof of
+// knowing the credential.
+type scramExchange struct {
+	method *ScramSHA256
+	step   int
+
+	username    string
+	cred        ScramCredential
+	known       bool   // false for an unknown user, who is failed at the end
+	gs2Header   string // e.g. "n,,"
+	clientFirst string // client-first-message-bare
+	serverFirst string
+	nonce       string
+}
+
+func (e *scramExchange) Next(data []byte) ([]byte, bool, error) {
+	e.step++
+	switch e.step {
+	case 1:
+		return e.first(string(data))
+	case 2:
+		return e.final(string(data))
+	}
+	return nil, false, errScram
+}
+
+func (e *scramExchange) Username() string {
+	return e.username
+}
+
+// Handle client-first-message: gs2-header "n=" username ",r=" nonce.
+func (e *scramExchange) first(msg string) ([]byte, bool, error) {
+	// No channel binding and no authorization identity.
+	if !strings.HasPrefix(msg, "n,,") && !strings.HasPrefix(msg, "y,,") {
+		return nil, false, errScram
+	}
+	e.gs2Header = msg[:3]
+	e.clientFirst = msg[3:]
+
+	attrs := scramAttributes(e.clientFirst)
+	user, ok := attrs["n"]
+	cnonce := attrs["r"]
+	if !ok || cnonce == "" {
+		return nil, false, errScram
+	}
+	user = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(user)
+
+	e.method.mu.RLock()
+	e.cred, e.known = e.method.users[user]
+	e.method.mu.RUnlock()
+	if !e.known {
+		// Go on with a made up credential, so that unknown users cannot
+		// be told from wrong passwords.
+		e.cred = ScramCredential{Salt: e.method.fakeSalt(user), Iterations: scramIterations}
+	}
+	e.username = user
+
+	snonce := make([]byte, 18)
+	if _, err := rand.Read(snonce); err != nil {
+		return nil, false, err
+	}
+	e.nonce = cnonce + base64.StdEncoding.EncodeToString(snonce)
+	e.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", e.nonce, base64.StdEncoding.EncodeToString(e.cred.Salt), e.cred.Iterations)
+	return []byte(e.serverFirst), false, nil
+}
+
+// The salt to give for an unknown user. It is the same each time for a
+// given user, as a real one would be, but cannot be told from a random
+// salt without the server's secret.
+func (s *ScramSHA256) fakeSalt(user string) []byte {
+	s.secretOnce.Do(func() {
+		s.secret = make([]byte, 32)
+		rand.Read(s.secret)
+	})
+	return hmacSHA256(s.secret, []byte(user))[:16]
+}
+
+// Handle client-final-message: "c=" channel binding ",r=" nonce ",p="
+// proof.
+func (e *scramExchange) final(msg string) ([]byte, bool, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, false, errScram
+	}
+	withoutProof := msg[:i]
+	attrs := scramAttributes(withoutProof)
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(e.gs2Header)) || attrs["r"] != e.nonce {
+		return nil, false, errScram
+	}
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil || len(proof) != sha256.Size || !e.known {
+		return nil, false, errScram
+	}
+
+	authMessage := []byte(e.clientFirst + "," + e.serverFirst + "," + withoutProof)
+	signature := hmacSHA256(e.cred.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for j := range proof {
+		clientKey[j] = proof[j] ^ signature[j]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], e.cred.StoredKey) != 1 {
+		return nil, false, errScram
+	}
+	serverSignature := hmacSHA256(e.cred.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), true, nil
+}
+
+// Split a SCRAM message into its attributes, by their one letter name.
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, a := range strings.Split(msg, ",") {
+		if len(a) >= 2 && a[1] == '=' {
+			attrs[a[:1]] = a[2:]
+		}
+	}
+	return attrs
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
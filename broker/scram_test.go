@@ -0,0 +1,126 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+func TestScramUnknownUser(t *testing.T) {
+	m := NewScramSHA256()
+	if err := m.AddUser("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	salt := func(user string) string {
+		out, _, err := m.Start(nil).Next([]byte("n,,n=" + user + ",r=nonce"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return scramAttributes(string(out))["s"]
+	}
+
+	// The same user always gets the same salt, as a known one does.
+	if a, b := salt("nobody"), salt("nobody"); a != b {
+		t.Errorf("salts %s and %s for the same unknown user", a, b)
+	}
+	if salt("nobody") == salt("someone") {
+		t.Error("same salt for different unknown users")
+	}
+	if got, want := salt("alice"), base64.StdEncoding.EncodeToString(m.users["alice"].Salt); got != want {
+		t.Errorf("salt %s for alice, want %s", got, want)
+	}
+}
+
+// scramLogin goes through a SCRAM-SHA-256 exchange as a client, passing
+// the client-first-message to send, and returns the packet ending it.
+func scramLogin(c *testClient, user, password string, send func(data []byte)) packets.ControlPacket {
+	c.t.Helper()
+	clientFirst := "n=" + user + ",r=cnonce"
+	send([]byte("n,," + clientFirst))
+	a, ok := c.read(2 * time.Second).(*packets.AuthPacket)
+	if !ok || a.ReasonCode != packets.ReasonContinueAuthentication {
+		c.t.Fatalf("got %v, want an AUTH to continue", a)
+	}
+	serverFirst := string(a.Properties.AuthData)
+	attrs := scramAttributes(serverFirst)
+	salt, _ := base64.StdEncoding.DecodeString(attrs["s"])
+
+	salted := pbkdf2([]byte(password), salt, scramIterations, sha256.Size, sha256.New)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	final := "c=biws,r=" + attrs["r"]
+	sig := hmacSHA256(storedKey[:], []byte(clientFirst+","+serverFirst+","+final))
+	for i := range clientKey {
+		clientKey[i] ^= sig[i]
+	}
+	auth := packets.NewControlPacket(packets.Auth).(*packets.AuthPacket)
+	auth.ReasonCode = packets.ReasonContinueAuthentication
+	auth.Properties = &packets.Properties{
+		AuthMethod: "SCRAM-SHA-256",
+		AuthData:   []byte(final + ",p=" + base64.StdEncoding.EncodeToString(clientKey)),
+	}
+	c.send(auth)
+	return c.read(2 * time.Second)
+}
+
+func TestScramReauthenticate(t *testing.T) {
+	m := NewScramSHA256()
+	m.AddUser("alice", "secret")
+	m.AddUser("bob", "hunter2")
+	acl := NewACL()
+	acl.AddTopic("alice", "alice/#", AccessReadWrite)
+	acl.AddTopic("bob", "bob/#", AccessReadWrite)
+	s := newTestServer(t, func(s *Server) {
+		s.AuthMethods = []AuthMethod{m}
+		s.Authz = acl
+	})
+
+	conn := newConnect("scram", true)
+	conn.ProtocolVersion = packets.Version5
+	nc, err := net.Dial("tcp", s.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	c := &testClient{t: t, conn: nc, version: packets.Version5}
+	ack, ok := scramLogin(c, "alice", "secret", func(data []byte) {
+		conn.Properties = &packets.Properties{AuthMethod: "SCRAM-SHA-256", AuthData: data}
+		c.send(conn)
+	}).(*packets.ConnackPacket)
+	if !ok || ack.ReturnCode != packets.Accepted {
+		t.Fatalf("got %v, want the CONNECT accepted", ack)
+	}
+
+	granted := func(id uint16, filter string) bool {
+		sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		sub.PacketID, sub.Topics, sub.Qoss = id, []string{filter}, []byte{0}
+		c.send(sub)
+		sa, ok := c.read(2 * time.Second).(*packets.SubackPacket)
+		if !ok {
+			t.Fatalf("no SUBACK for %s", filter)
+		}
+		return sa.GrantedQoss[0] < 0x80
+	}
+	if !granted(1, "alice/x") || granted(2, "bob/x") {
+		t.Fatal("alice's access not applied")
+	}
+
+	// Once re-authenticated as bob, bob's access applies.
+	done, ok := scramLogin(c, "bob", "hunter2", func(data []byte) {
+		auth := packets.NewControlPacket(packets.Auth).(*packets.AuthPacket)
+		auth.ReasonCode = packets.ReasonReAuthenticate
+		auth.Properties = &packets.Properties{AuthMethod: "SCRAM-SHA-256", AuthData: data}
+		c.send(auth)
+	}).(*packets.AuthPacket)
+	if !ok || done.ReasonCode != packets.ReasonSuccess || !bytes.HasPrefix(done.Properties.AuthData, []byte("v=")) {
+		t.Fatalf("got %v, want re-authentication to succeed", done)
+	}
+	if granted(3, "alice/x") || !granted(4, "bob/x") {
+		t.Fatal("bob's access not applied after re-authentication")
+	}
+}
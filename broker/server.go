@@ -6,34 +6,67 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/zwczou/mqtt/packets"
 )
 
 // A Server holds all the state associated with an MQTT server.
 type Server struct {
 	sync.WaitGroup
-	l               net.Listener
-	subs            *subscriptions
-	stats           *stats
-	StatsInterval   time.Duration // Defaults to 10 seconds. Must be set using sync/atomic.StoreInt64().
-	SendQueueLength int
-	Dump            bool // When true, dump the messages in and out.
-	stop            chan struct{}
+	lmu                 sync.Mutex // guards l and listeners
+	l                   net.Listener
+	listeners           []net.Listener // added by AddListener
+	subs                *subscriptions
+	sessions            *sessions
+	stats               *stats
+	StatsInterval       time.Duration // Defaults to 10 seconds. Must be set using sync/atomic.StoreInt64().
+	SendQueueLength     int
+	MaxQueuedMessages   int           // Defaults to 1000. Queued QoS 1 and 2 messages per session.
+	MaxQueuedBytes      int           // Topic and payload bytes of the queued messages per session; 0 for no limit.
+	QueuePolicy         QueuePolicy   // What to drop when a queue is full. Defaults to QueueRejectNew.
+	MaxInflightMessages int           // Defaults to 20. Unacknowledged QoS 1 and 2 messages per session.
+	RetryInterval       time.Duration // Defaults to 20 seconds. Zero resends only on reconnect.
+	MaxQoS              byte          // Defaults to 2. Upper bound of the QoS granted to subscriptions, and of PUBLISH from MQTT 5 clients.
+	SharePolicy         SharePolicy   // How shared subscriptions pick a member. Defaults to ShareRoundRobin.
+	TopicAliasMaximum   uint16        // Defaults to 10. Topic aliases an MQTT 5 client may set up; 0 for none.
+	ReceiveMaximum      uint16        // Defaults to 100. Inbound QoS 2 messages an MQTT 5 client may have waiting for PUBREL.
+	MaxPacketSize       int           // Defaults to 1 MB. Larger inbound packets close the connection; 0 for no limit.
+	ResponseInfoPrefix  string        // When set, offered with the client id appended as response information.
+	ServerReference     string        // When set, given to MQTT 5 clients disconnected by Kick or Stop, to use another server.
+	Dump                bool          // When true, dump the messages in and out.
+	Auth                Authenticator // When set, consulted before accepting a CONNECT.
+	AuthMethods         []AuthMethod  // MQTT 5 enhanced authentication methods offered to clients.
+	Authz               Authorizer    // When set, consulted for every PUBLISH and SUBSCRIBE.
+	Store               Store         // Where sessions and retained messages are kept. Defaults to NewMemoryStore().
+	CertIdentity        CertIdentity  // What a verified client certificate names, on a TLS listener. Defaults to CertIdentityNone.
+	stop                chan struct{}
+	started             int32 // set by Start, with sync/atomic
 }
 
 // NewServer creates a new MQTT server, which accepts connections from
-// the given listener. When the server is stopped (for instance by
-// another goroutine closing the net.Listener), channel Stop will become
-// readable.
+// the given listener, and from those given to AddListener. When the
+// server is stopped (for instance by another goroutine closing the
+// net.Listeners), channel Stop will become readable.
 func NewServer(l net.Listener) *Server {
 	svr := &Server{
-		l:               l,
-		stats:           &stats{},
-		stop:            make(chan struct{}),
-		StatsInterval:   time.Second * 10,
-		SendQueueLength: 20,
-		subs:            newSubscriptions(runtime.NumCPU()),
+		l:                   l,
+		stats:               &stats{},
+		stop:                make(chan struct{}),
+		StatsInterval:       time.Second * 10,
+		SendQueueLength:     20,
+		MaxQueuedMessages:   1000,
+		MaxInflightMessages: 20,
+		RetryInterval:       time.Second * 20,
+		MaxQoS:              2,
+		TopicAliasMaximum:   10,
+		ReceiveMaximum:      100,
+		MaxPacketSize:       1 << 20,
+		Store:               NewMemoryStore(),
 	}
+	svr.subs = newSubscriptions(svr, runtime.NumCPU())
+	svr.sessions = newSessions(svr)
 
 	// start the stats reporting goroutine
 	go func() {
@@ -42,6 +75,7 @@ func NewServer(l net.Listener) *Server {
 			select {
 			case <-ticker.C:
 				svr.stats.publish(svr.subs, svr.StatsInterval)
+				svr.subs.expireRetained()
 			case <-svr.stop:
 				return
 			}
@@ -51,42 +85,169 @@ func NewServer(l net.Listener) *Server {
 	return svr
 }
 
-// Start makes the Server start accepting and handling connections.
+// Start makes the Server start accepting and handling connections, once
+// the sessions and retained messages of its Store are loaded.
 func (s *Server) Start() {
+	atomic.StoreInt32(&s.started, 1)
+	log.Printf("INFO: loaded %d retained messages", s.subs.expireRetained())
+	n, msgs, err := s.sessions.load()
+	if err != nil {
+		log.Printf("ERROR: failed to load sessions - %s", err)
+	}
+	log.Printf("INFO: loaded %d sessions with %d messages", n, msgs)
+
+	var accepting sync.WaitGroup
+	for _, l := range s.allListeners() {
+		accepting.Add(1)
+		go func(l net.Listener) {
+			s.accept(l)
+			accepting.Done()
+		}(l)
+	}
 	s.Add(1)
 	go func() {
-		for {
-			conn, err := s.l.Accept()
-			if err != nil {
-				if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-					log.Printf("NOTICE: temporary Accept() failure - %s", err)
-					runtime.Gosched()
-					continue
-				}
-
-				if strings.Contains(err.Error(), "use of closed") {
-					break
-				}
-
-				log.Print("INFO: failed to accept -", err)
+		accepting.Wait()
+		close(s.stop)
+		s.Done()
+	}()
+}
+
+// AddListener makes the Server accept connections from another listener,
+// such as a TLSListener next to a plain TCP one. It must be called before
+// Start.
+func (s *Server) AddListener(l net.Listener) {
+	s.lmu.Lock()
+	s.listeners = append(s.listeners, l)
+	s.lmu.Unlock()
+}
+
+// The listeners of the Server, none once it is stopped.
+func (s *Server) allListeners() []net.Listener {
+	s.lmu.Lock()
+	defer s.lmu.Unlock()
+	var all []net.Listener
+	if s.l != nil {
+		all = append(all, s.l)
+	}
+	return append(all, s.listeners...)
+}
+
+// Accept connections from a listener, until it is closed.
+func (s *Server) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				log.Printf("NOTICE: temporary Accept() failure - %s", err)
+				runtime.Gosched()
+				continue
+			}
+
+			if strings.Contains(err.Error(), "use of closed") {
 				break
 			}
 
-			cli := s.newIncomingConn(conn)
-			s.stats.clientConnect()
-			cli.start()
+			log.Print("INFO: failed to accept -", err)
+			break
 		}
-		close(s.stop)
-		s.Done()
-	}()
+
+		cli := s.newIncomingConn(conn)
+		s.stats.clientConnect()
+		cli.start()
+	}
+}
+
+// A Reloader is an Authenticator, Authorizer, AuthMethod or listener that
+// can reread its configuration, such as PasswordFile, ScramSHA256, an ACL
+// loaded by NewACLFile and a TLSListener.
+type Reloader interface {
+	Reload() error
+}
+
+// Reload makes the Authenticator, the Authorizer, the AuthMethods and the
+// listeners reread their configuration, if they are Reloaders. Existing connections
+// are kept, and the new configuration applies from their next packet on.
+// Those failing to reload keep their previous configuration, without
+// stopping the others; the error then lists their errors.
+func (s *Server) Reload() error {
+	reloadable := []interface{}{s.Auth, s.Authz}
+	for _, l := range s.allListeners() {
+		reloadable = append(reloadable, l)
+	}
+	for _, m := range s.AuthMethods {
+		reloadable = append(reloadable, m)
+	}
+	var errs reloadErrors
+	for _, v := range reloadable {
+		if r, ok := v.(Reloader); ok {
+			if err := r.Reload(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// The errors of the Reloaders that failed to reload.
+type reloadErrors []error
+
+func (e reloadErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Find the enhanced authentication method of the given name, or nil.
+func (s *Server) authMethod(name string) AuthMethod {
+	for _, m := range s.AuthMethods {
+		if m.Name() == name {
+			return m
+		}
+	}
+	return nil
 }
 
+// Kick disconnects a client, telling an MQTT 5 client that it is an
+// administrative action. It returns false if the client is not connected.
+func (s *Server) Kick(clientid string) bool {
+	c := s.sessions.conn(clientid)
+	if c == nil {
+		return false
+	}
+	c.kick(packets.ReasonAdministrativeAction)
+	return true
+}
+
+// Stop closes the listeners, then disconnects the clients, telling MQTT 5
+// clients that the server is shutting down, and stops the server.
 func (s *Server) Stop() {
-	close(s.subs.stop)
-	s.subs.Wait()
+	s.lmu.Lock()
 	if s.l != nil {
 		s.l.Close()
 		s.l = nil
 	}
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = nil
+	s.lmu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range s.sessions.connections() {
+		wg.Add(1)
+		go func(c *incomingConn) {
+			c.kick(packets.ReasonServerShuttingDown)
+			wg.Done()
+		}(c)
+	}
+	wg.Wait()
+
+	close(s.subs.stop)
+	s.subs.Wait()
 	s.Wait()
 }
@@ -0,0 +1,823 @@
+package broker
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+// A session holds the state of a client that can outlive its connection:
+// its subscriptions, the QoS 1 and 2 messages sent to it and not yet
+// acknowledged, and those waiting to be sent, either because the client
+// is offline or because too many messages are in flight. The
+// subscriptions refer to the session rather than to the connection, so
+// they keep matching while the client is away.
+type session struct {
+	svr      *Server
+	clientid string
+
+	mu          sync.Mutex // guards access to fields below
+	c           *incomingConn
+	stored      bool      // written through to the server's Store
+	expiry      uint32    // Session Expiry Interval, in seconds
+	expires     time.Time // when the detached session ends; zero if never
+	timer       *time.Timer
+	ended       bool // a will released from now on is published right away
+	will        *delayedWill
+	subs        map[string]subscription // by topic filter
+	queue       []queued
+	queuedBytes int
+	inflight    []*inflight // in the order they were sent
+	nextID      uint16
+	lastMID     uint64          // id of the last message given to the session
+	incoming    map[uint16]bool // inbound QoS 2 packet ids waiting for PUBREL
+}
+
+// A queued is an outbound QoS 1 or 2 message waiting to be put in
+// flight.
+type queued struct {
+	m       *packets.PublishPacket
+	expires time.Time // zero if the message never expires
+	id      uint64    // in the server's Store; zero if not stored
+}
+
+// An inflight is an outbound QoS 1 or 2 message waiting for the client
+// to acknowledge it.
+type inflight struct {
+	m       *packets.PublishPacket
+	pubrel  bool // PUBREC received, waiting for PUBCOMP
+	sent    time.Time
+	expires time.Time
+	id      uint64
+}
+
+// A QueuePolicy decides which message is dropped when one arrives for a
+// session whose queue is full.
+type QueuePolicy int
+
+const (
+	QueueRejectNew  QueuePolicy = iota // the new one
+	QueueDropOldest                    // the oldest queued ones, as many as it takes
+)
+
+// A delayedWill is the will message of a connection that went away,
+// waiting for its Will Delay Interval to pass.
+type delayedWill struct {
+	c     *incomingConn
+	m     *packets.PublishPacket
+	timer *time.Timer
+}
+
+// The Session Expiry Interval that never ends a session.
+const neverExpire = 0xFFFFFFFF
+
+// The Session Expiry Interval asked for by a CONNECT. Before MQTT 5, a
+// clean session ends with its connection, and the others never end.
+func sessionExpiry(m *packets.ConnectPacket) uint32 {
+	if m.ProtocolVersion != packets.Version5 {
+		if m.CleanSession {
+			return 0
+		}
+		return neverExpire
+	}
+	if m.Properties == nil || m.Properties.SessionExpiryInterval == nil {
+		return 0
+	}
+	return *m.Properties.SessionExpiryInterval
+}
+
+// Copy a message so that it can be changed for one subscriber, keeping
+// its QoS, retain flag and the properties that travel with it.
+func copyPublish(m *packets.PublishPacket) *packets.PublishPacket {
+	p := m.Copy()
+	p.Qos = m.Qos
+	p.Retain = m.Retain
+	p.Properties = messageProperties(m.Properties)
+	return p
+}
+
+// Copy the properties of an application message that are passed on
+// unchanged to its subscribers, leaving out those that only make sense
+// on the connection it came in on, such as the topic alias. It returns
+// nil if there are none.
+func messageProperties(p *packets.Properties) *packets.Properties {
+	if p == nil {
+		return nil
+	}
+	c := p.Copy()
+	return &packets.Properties{
+		PayloadFormat:   c.PayloadFormat,
+		MessageExpiry:   c.MessageExpiry,
+		ContentType:     c.ContentType,
+		ResponseTopic:   c.ResponseTopic,
+		CorrelationData: c.CorrelationData,
+		User:            c.User,
+	}
+}
+
+func newSession(svr *Server, clientid string, expiry uint32) *session {
+	return &session{
+		svr:      svr,
+		clientid: clientid,
+		expiry:   expiry,
+		subs:     make(map[string]subscription),
+		incoming: make(map[uint16]bool),
+	}
+}
+
+// Attach a connection to the session. This cancels the delayed will of
+// the previous connection, if any. Messages that were in flight are sent
+// again, then those queued while the client was offline.
+func (s *session) attach(c *incomingConn) {
+	s.mu.Lock()
+	s.c = c
+	if s.will != nil {
+		s.will.timer.Stop()
+		s.will = nil
+	}
+	out := s.retry(0)
+	out = append(out, s.fill()...)
+	s.mu.Unlock()
+
+	for _, j := range out {
+		c.submitJob(j)
+	}
+}
+
+// Send again the in-flight messages that have waited for an
+// acknowledgement longer than the given age, if the connection is still
+// attached.
+func (s *session) resend(c *incomingConn, age time.Duration) {
+	s.mu.Lock()
+	var out []job
+	if s.c == c {
+		out = s.retry(age)
+	}
+	s.mu.Unlock()
+
+	for _, j := range out {
+		c.submitJob(j)
+	}
+}
+
+// Build the packets to send again for the in-flight messages older than
+// age: the PUBLISH with the DUP flag set, or the PUBREL once the client
+// has sent PUBREC. The caller must hold s.mu.
+func (s *session) retry(age time.Duration) []job {
+	var out []job
+	now := time.Now()
+	for _, f := range s.inflight {
+		if now.Sub(f.sent) < age {
+			continue
+		}
+		f.sent = now
+		if f.pubrel {
+			pr := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			pr.PacketID = f.m.PacketID
+			out = append(out, job{m: pr})
+		} else {
+			p := copyPublish(f.m)
+			p.PacketID = f.m.PacketID
+			p.Dup = true
+			out = append(out, job{m: p, expires: f.expires})
+		}
+	}
+	return out
+}
+
+// Move queued messages in flight while the client is connected and the
+// window has room, returning the packets to send. Messages that expired
+// while queued are dropped. The caller must hold s.mu.
+func (s *session) fill() []job {
+	var out []job
+	now := time.Now()
+	for s.c != nil && len(s.queue) > 0 && len(s.inflight) < s.window() {
+		q := s.pop()
+		if expired(q.expires, now) || !s.c.fits(q.m) {
+			s.svr.stats.messageDrop()
+			s.deleteMessage(q.id)
+			continue
+		}
+		out = append(out, job{m: s.send(q.m, q.expires, q.id), expires: q.expires})
+	}
+	return out
+}
+
+// Take the oldest message off the queue. The caller must hold s.mu.
+func (s *session) pop() queued {
+	q := s.queue[0]
+	s.queue[0] = queued{}
+	s.queue = s.queue[1:]
+	s.queuedBytes -= queuedSize(q.m)
+	return q
+}
+
+// The size a message counts for in the queue.
+func queuedSize(m *packets.PublishPacket) int {
+	return len(m.TopicName) + len(m.Payload)
+}
+
+// Report whether the queue has no room left for a message, according to
+// the server's MaxQueuedMessages and MaxQueuedBytes. The caller must hold
+// s.mu.
+func (s *session) full(m *packets.PublishPacket) bool {
+	max := s.svr.MaxQueuedBytes
+	return len(s.queue) >= s.svr.MaxQueuedMessages ||
+		max > 0 && s.queuedBytes+queuedSize(m) > max
+}
+
+// The number of messages that may be in flight: the server's
+// MaxInflightMessages, lowered to the Receive Maximum of an MQTT 5
+// client. The caller must hold s.mu.
+func (s *session) window() int {
+	n := s.svr.MaxInflightMessages
+	if s.c != nil && s.c.receiveMax > 0 && int(s.c.receiveMax) < n {
+		n = int(s.c.receiveMax)
+	}
+	return n
+}
+
+// Drop the queued messages that have expired. The caller must hold s.mu.
+func (s *session) prune() {
+	now := time.Now()
+	kept := s.queue[:0]
+	for _, q := range s.queue {
+		if expired(q.expires, now) {
+			s.svr.stats.messageDrop()
+			s.deleteMessage(q.id)
+			s.queuedBytes -= queuedSize(q.m)
+			continue
+		}
+		kept = append(kept, q)
+	}
+	for i := len(kept); i < len(s.queue); i++ {
+		s.queue[i] = queued{}
+	}
+	s.queue = kept
+}
+
+// Put a QoS 1 or 2 message in flight under a fresh packet id. The caller
+// must hold s.mu.
+func (s *session) send(m *packets.PublishPacket, expires time.Time, id uint64) *packets.PublishPacket {
+	for {
+		s.nextID++
+		if s.nextID != 0 && s.find(s.nextID) < 0 {
+			break
+		}
+	}
+	m.PacketID = s.nextID
+	f := &inflight{m: m, sent: time.Now(), expires: expires, id: id}
+	s.inflight = append(s.inflight, f)
+	s.putMessage(f.id, f.m, f.expires, f.m.PacketID, false)
+	return m
+}
+
+// Give a message to the session, returning its id, which is zero unless
+// the session is stored. The caller must hold s.mu.
+func (s *session) newMessage(m *packets.PublishPacket, expires time.Time) uint64 {
+	if !s.stored {
+		return 0
+	}
+	s.lastMID++
+	s.putMessage(s.lastMID, m, expires, 0, false)
+	return s.lastMID
+}
+
+// Write a message of the session through to the Store, unless its id is
+// zero. The caller must hold s.mu.
+func (s *session) putMessage(id uint64, m *packets.PublishPacket, expires time.Time, packetID uint16, pubrel bool) {
+	if id == 0 || !s.stored {
+		return
+	}
+	msg := StoredMessage{ID: id, Message: m, Expires: expires, PacketID: packetID, Pubrel: pubrel}
+	if err := s.svr.Store.PutMessage(s.clientid, msg); err != nil {
+		log.Printf("ERROR: failed to store a message for %s - %s", s.clientid, err)
+	}
+}
+
+// Remove a message of the session from the Store, unless its id is zero.
+// The caller must hold s.mu.
+func (s *session) deleteMessage(id uint64) {
+	if id == 0 || !s.stored {
+		return
+	}
+	if err := s.svr.Store.DeleteMessage(s.clientid, id); err != nil {
+		log.Printf("ERROR: failed to delete a message for %s - %s", s.clientid, err)
+	}
+}
+
+// Find the index of an in-flight message, or -1. The caller must hold
+// s.mu.
+func (s *session) find(id uint16) int {
+	for i, f := range s.inflight {
+		if f.m.PacketID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// The client sent PUBREC for a QoS 2 message: from now on it waits for
+// PUBCOMP, and PUBREL is what gets sent again.
+func (s *session) received(id uint16) {
+	s.mu.Lock()
+	if i := s.find(id); i >= 0 && s.inflight[i].m.Qos == 2 {
+		f := s.inflight[i]
+		f.pubrel = true
+		s.putMessage(f.id, f.m, f.expires, f.m.PacketID, true)
+	}
+	s.mu.Unlock()
+}
+
+// The client acknowledged a message with PUBACK (QoS 1) or PUBCOMP
+// (QoS 2). It leaves the window, making room for a queued message.
+func (s *session) complete(id uint16) {
+	s.mu.Lock()
+	if i := s.find(id); i >= 0 {
+		s.remove(i)
+	}
+	c := s.c
+	out := s.fill()
+	s.mu.Unlock()
+
+	for _, j := range out {
+		c.submitJob(j)
+	}
+}
+
+// Drop the in-flight PUBLISH of a packet id if it expired before the
+// client acknowledged it, as the writer of connection c found when about
+// to send it. The packets to send to c in its place are returned, for
+// the writer to send itself.
+func (s *session) expireInflight(c *incomingConn, id uint16) []job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.c != c {
+		return nil
+	}
+	if i := s.find(id); i >= 0 && !s.inflight[i].pubrel && expired(s.inflight[i].expires, time.Now()) {
+		s.remove(i)
+	}
+	return s.fill()
+}
+
+// Remove the in-flight message at index i, and from the Store. The
+// caller must hold s.mu.
+func (s *session) remove(i int) {
+	s.deleteMessage(s.inflight[i].id)
+	copy(s.inflight[i:], s.inflight[i+1:])
+	s.inflight[len(s.inflight)-1] = nil
+	s.inflight = s.inflight[:len(s.inflight)-1]
+}
+
+// Change the Session Expiry Interval, as a client may do when it
+// disconnects.
+func (s *session) setExpiry(expiry uint32) {
+	s.mu.Lock()
+	s.expiry = expiry
+	s.putSession()
+	s.mu.Unlock()
+}
+
+// Publish the delayed will, if it is still pending.
+func (s *session) fireWill() {
+	s.mu.Lock()
+	w := s.will
+	s.will = nil
+	s.mu.Unlock()
+
+	if w != nil {
+		w.timer.Stop()
+		w.c.publish(w.m)
+	}
+}
+
+// Write the session through to the Store, if it is stored. The caller
+// must hold s.mu.
+func (s *session) putSession() {
+	if !s.stored {
+		return
+	}
+	if err := s.svr.Store.PutSession(StoredSession{ClientID: s.clientid, Expiry: s.expiry}); err != nil {
+		log.Printf("ERROR: failed to store the session of %s - %s", s.clientid, err)
+	}
+}
+
+// Record a subscription, replacing any existing subscription to the same
+// topic filter. It returns true if there was one.
+func (s *session) subscribe(topic string, sub subscription) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.subs[topic]
+	s.subs[topic] = sub
+	if s.stored {
+		stored := StoredSubscription{Filter: topic, QoS: sub.qos, Options: sub.opts}
+		if len(sub.ids) > 0 {
+			stored.Identifier = sub.ids[0]
+		}
+		if err := s.svr.Store.PutSubscription(s.clientid, stored); err != nil {
+			log.Printf("ERROR: failed to store a subscription of %s - %s", s.clientid, err)
+		}
+	}
+	return ok
+}
+
+// Forget a subscription. It returns false if there was none.
+func (s *session) unsubscribe(topic string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.subs[topic]
+	delete(s.subs, topic)
+	if ok && s.stored {
+		if err := s.svr.Store.DeleteSubscription(s.clientid, topic); err != nil {
+			log.Printf("ERROR: failed to delete a subscription of %s - %s", s.clientid, err)
+		}
+	}
+	return ok
+}
+
+// Report whether an inbound QoS 2 message stays within max messages
+// waiting for PUBREL. A retransmission always does.
+func (s *session) accepts(id uint16, max int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.incoming[id] || len(s.incoming) < max
+}
+
+// Note the packet id of an inbound QoS 2 message. It returns false if the
+// id is still waiting for PUBREL, in which case the message is a
+// retransmission of one that was already passed on.
+func (s *session) receive(id uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.incoming[id] {
+		return false
+	}
+	s.incoming[id] = true
+	return true
+}
+
+// The client sent PUBREL for an inbound QoS 2 message, so its packet id
+// may be used for a new message.
+func (s *session) release(id uint16) {
+	s.mu.Lock()
+	delete(s.incoming, id)
+	s.mu.Unlock()
+}
+
+// Report whether the client is connected and keeping up: nothing is
+// queued for it and its send queue has room.
+func (s *session) ready() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c != nil && len(s.queue) == 0 && len(s.c.jobs) < cap(s.c.jobs)
+}
+
+// Deliver a copy of a message to the client, through a subscription
+// granted at the given QoS. The copy has the lower of the two QoS. QoS 0
+// messages are sent if the client is connected. QoS 1 and 2 messages are
+// put in flight if the client is connected and the window has room, and
+// queued otherwise. When the queue is full, the server's QueuePolicy says
+// whether older messages make room for it; if not, the message is dropped
+// and a connected MQTT 5 client disconnected. A
+// message is also dropped instead of sent once its expiry time, if any,
+// has passed, or if it is larger than the client's Maximum Packet Size.
+// The copy carries the given Subscription Identifiers. The QoS 1 and 2
+// messages of a stored session are written through to the server's Store.
+func (s *session) deliver(m *packets.PublishPacket, qos byte, ids []int, expires time.Time) {
+	m = copyPublish(m)
+	if m.Qos > qos {
+		m.Qos = qos
+	}
+	if len(ids) > 0 {
+		if m.Properties == nil {
+			m.Properties = &packets.Properties{}
+		}
+		m.Properties.SubscriptionIdentifier = ids
+	}
+
+	s.mu.Lock()
+	c := s.c
+	if s.full(m) {
+		// Make room by dropping what has expired.
+		s.prune()
+	}
+	var out *packets.PublishPacket
+	switch {
+	case c != nil && !c.fits(m):
+		// Too large for the client: discarded as if it had been sent.
+		s.svr.stats.messageDrop()
+	case m.Qos == 0:
+		if c != nil {
+			out = m
+		}
+	case c != nil && len(s.queue) == 0 && len(s.inflight) < s.window():
+		out = s.send(m, expires, s.newMessage(m, expires))
+	case s.full(m) && s.svr.QueuePolicy == QueueRejectNew:
+		s.svr.stats.messageDrop()
+		if c != nil && c.version == packets.Version5 {
+			// An MQTT 5 client that cannot keep up is told so, and
+			// gets what is queued when it comes back.
+			go c.kick(packets.ReasonQuotaExceeded)
+		}
+	case s.svr.MaxQueuedBytes > 0 && queuedSize(m) > s.svr.MaxQueuedBytes:
+		// Too large for the queue on its own: no use dropping others.
+		s.svr.stats.messageDrop()
+	default:
+		for len(s.queue) > 0 && s.full(m) {
+			s.svr.stats.messageDrop()
+			s.deleteMessage(s.pop().id)
+		}
+		if s.full(m) {
+			s.svr.stats.messageDrop()
+			break
+		}
+		s.queue = append(s.queue, queued{m: m, expires: expires, id: s.newMessage(m, expires)})
+		s.queuedBytes += queuedSize(m)
+	}
+	s.mu.Unlock()
+
+	if out != nil {
+		c.submitJob(job{m: out, expires: expires})
+	}
+}
+
+// The sessions of a Server, and the connections of their clients, indexed
+// by client id.
+type sessions struct {
+	svr *Server
+
+	mu    sync.Mutex // guards access to fields below
+	m     map[string]*session
+	conns map[string]*incomingConn
+}
+
+func newSessions(svr *Server) *sessions {
+	return &sessions{
+		svr:   svr,
+		m:     make(map[string]*session),
+		conns: make(map[string]*incomingConn),
+	}
+}
+
+// Register the connection of a client. If a connection already exists for
+// the same client id, it is replaced and returned.
+func (ss *sessions) connect(c *incomingConn) *incomingConn {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	existing := ss.conns[c.clientid]
+	ss.conns[c.clientid] = c
+	return existing
+}
+
+// Forget the connection of a client; it must be closed by the caller
+// first. Nothing is forgotten if the client id now belongs to another
+// connection.
+func (ss *sessions) disconnect(c *incomingConn) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.conns[c.clientid] == c {
+		delete(ss.conns, c.clientid)
+	}
+}
+
+// The connection of a client, or nil.
+func (ss *sessions) conn(clientid string) *incomingConn {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.conns[clientid]
+}
+
+// All the connections of clients.
+func (ss *sessions) connections() []*incomingConn {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	list := make([]*incomingConn, 0, len(ss.conns))
+	for _, c := range ss.conns {
+		list = append(list, c)
+	}
+	return list
+}
+
+// Find the session to use for a client, with the given Session Expiry
+// Interval. Unless clean is set, an existing session is resumed, and
+// present is true; a session that was to end with its connection cannot
+// be resumed, though. Otherwise the existing session ends, and a fresh
+// session is returned. Sessions that may outlive their connection are
+// written through to the server's Store.
+func (ss *sessions) get(clientid string, clean bool, expiry uint32) (s *session, present bool) {
+	ss.mu.Lock()
+	old, ok := ss.m[clientid]
+	if ok {
+		old.mu.Lock()
+		if !clean && old.expiry != 0 {
+			old.expiry = expiry
+			old.putSession()
+			old.expires = time.Time{}
+			if old.timer != nil {
+				old.timer.Stop()
+			}
+			old.mu.Unlock()
+			ss.mu.Unlock()
+			return old, true
+		}
+		// Should its connection still be around, the session ends as
+		// soon as it goes away. It is no longer written through, as the
+		// Store knows sessions by client id.
+		old.expiry = 0
+		stored := old.stored
+		old.stored = false
+		old.mu.Unlock()
+		if stored {
+			ss.deleteSession(clientid)
+		}
+	}
+	s = newSession(ss.svr, clientid, expiry)
+	if expiry != 0 {
+		s.stored = true
+		s.putSession()
+	}
+	ss.m[clientid] = s
+	ss.mu.Unlock()
+
+	if ok {
+		ss.end(old)
+	}
+	return s, false
+}
+
+// Release the session of a connection that is going away, with the will
+// message to publish, if any. A session with a zero Session Expiry
+// Interval ends with its connection; the others stay around, queueing
+// messages until the client comes back or the interval has passed. The
+// will is published right away, unless the client asked for a Will
+// Delay Interval: then it waits for the delay to pass, or the session to
+// end, and is dropped if the client reconnects first.
+func (ss *sessions) release(c *incomingConn, will *packets.PublishPacket) {
+	s := c.sess
+	delay := willDelay(c.connect)
+
+	s.mu.Lock()
+	if s.c != c {
+		// Taken over by a new connection, which cancels a delayed will.
+		s.mu.Unlock()
+		if will != nil && delay == 0 {
+			c.publish(will)
+		}
+		return
+	}
+	s.c = nil
+	expiry := s.expiry
+	if expiry != 0 && expiry != neverExpire {
+		s.expires = time.Now().Add(time.Duration(expiry) * time.Second)
+		s.timer = time.AfterFunc(time.Duration(expiry)*time.Second, func() { ss.expire(s) })
+	}
+	if expiry != 0 && !s.ended && will != nil && delay > 0 {
+		s.will = &delayedWill{c: c, m: will}
+		s.will.timer = time.AfterFunc(time.Duration(delay)*time.Second, s.fireWill)
+		will = nil
+	}
+	s.mu.Unlock()
+
+	if will != nil {
+		c.publish(will)
+	}
+	if expiry == 0 {
+		ss.end(s)
+	}
+}
+
+// End a session whose expiry time has passed, unless a client has
+// resumed it in the meantime.
+func (ss *sessions) expire(s *session) {
+	ss.mu.Lock()
+	s.mu.Lock()
+	ok := s.c == nil && !s.expires.IsZero() && !time.Now().Before(s.expires)
+	stored := ok && s.stored
+	if stored {
+		s.stored = false
+	}
+	if ok {
+		s.ended = true
+	}
+	s.mu.Unlock()
+	if ok && ss.m[s.clientid] == s {
+		delete(ss.m, s.clientid)
+		if stored {
+			ss.deleteSession(s.clientid)
+		}
+	}
+	ss.mu.Unlock()
+
+	if ok {
+		ss.svr.subs.unsubAll(s)
+		s.fireWill()
+	}
+}
+
+// End a session: forget it and its subscriptions, and publish its
+// delayed will, if any. The connection of a session taken over may not
+// have released it yet; its will is then published as it does.
+func (ss *sessions) end(s *session) {
+	ss.mu.Lock()
+	s.mu.Lock()
+	stored := s.stored
+	s.stored = false
+	s.ended = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.mu.Unlock()
+	if ss.m[s.clientid] == s {
+		delete(ss.m, s.clientid)
+		if stored {
+			ss.deleteSession(s.clientid)
+		}
+	}
+	ss.mu.Unlock()
+
+	ss.svr.subs.unsubAll(s)
+	s.fireWill()
+}
+
+// Remove a session from the Store. The caller must hold ss.mu, so that
+// the session of a client id is not stored again meanwhile.
+func (ss *sessions) deleteSession(clientid string) {
+	if err := ss.svr.Store.DeleteSession(clientid); err != nil {
+		log.Printf("ERROR: failed to delete the session of %s - %s", clientid, err)
+	}
+}
+
+// Rebuild the sessions kept in the server's Store, as they were when the
+// server went away, but detached: the messages that were in flight are
+// sent again when the client comes back, then those queued. Sessions
+// that expire do so counting from now. It returns the number of sessions
+// and messages loaded.
+func (ss *sessions) load() (n, msgs int, err error) {
+	var stored []StoredSession
+	err = ss.svr.Store.Sessions(func(s StoredSession) bool {
+		stored = append(stored, s)
+		return true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, st := range stored {
+		s := newSession(ss.svr, st.ClientID, st.Expiry)
+		s.stored = true
+		subs, err := ss.svr.Store.Subscriptions(st.ClientID)
+		if err != nil {
+			return n, msgs, err
+		}
+		for _, sub := range subs {
+			restored := subscription{s: s, qos: sub.QoS, opts: sub.Options}
+			if sub.Identifier != 0 {
+				restored.ids = []int{sub.Identifier}
+			}
+			s.subs[sub.Filter] = restored
+			ss.svr.subs.add(sub.Filter, restored)
+		}
+		list, err := ss.svr.Store.Messages(st.ClientID)
+		if err != nil {
+			return n, msgs, err
+		}
+		for _, msg := range list {
+			if msg.ID > s.lastMID {
+				s.lastMID = msg.ID
+			}
+			if msg.PacketID == 0 {
+				s.queue = append(s.queue, queued{m: msg.Message, expires: msg.Expires, id: msg.ID})
+				s.queuedBytes += queuedSize(msg.Message)
+				continue
+			}
+			// The packet id of a stored message does not count.
+			m := *msg.Message
+			m.PacketID = msg.PacketID
+			s.inflight = append(s.inflight, &inflight{m: &m, pubrel: msg.Pubrel, expires: msg.Expires, id: msg.ID})
+			if msg.PacketID > s.nextID {
+				s.nextID = msg.PacketID
+			}
+		}
+		msgs += len(list)
+		if st.Expiry != neverExpire {
+			s.expires = time.Now().Add(time.Duration(st.Expiry) * time.Second)
+			s.timer = time.AfterFunc(time.Duration(st.Expiry)*time.Second, func() { ss.expire(s) })
+		}
+
+		ss.mu.Lock()
+		ss.m[s.clientid] = s
+		ss.mu.Unlock()
+		n++
+	}
+	return n, msgs, nil
+}
+
+// The Will Delay Interval of a client, in seconds.
+func willDelay(m *packets.ConnectPacket) uint32 {
+	if m == nil || m.WillProperties == nil || m.WillProperties.WillDelayInterval == nil {
+		return 0
+	}
+	return *m.WillProperties.WillDelayInterval
+}
@@ -0,0 +1,411 @@
+package broker
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+func TestQoS2Replay(t *testing.T) {
+	s := newTestServer(t, nil)
+	sub, _ := connectTo(t, s, newConnect("sub", true))
+	sub.subscribe(1, "q2", 0)
+	pub, _ := connectTo(t, s, newConnect("pub", true))
+
+	// The PUBLISH is sent again, as after a lost PUBREC, before PUBREL.
+	for i := 0; i < 3; i++ {
+		m := newPublish(7, "q2", 2, "once")
+		m.Dup = i > 0
+		pub.send(m)
+		if rec, ok := pub.read(2 * time.Second).(*packets.PubrecPacket); !ok || rec.PacketID != 7 {
+			t.Fatalf("PUBLISH %d: got %v, want PUBREC 7", i, rec)
+		}
+	}
+	rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	rel.PacketID = 7
+	pub.send(rel)
+	if comp, ok := pub.read(2 * time.Second).(*packets.PubcompPacket); !ok || comp.PacketID != 7 {
+		t.Fatalf("got %v, want PUBCOMP 7", comp)
+	}
+	// Once released, the packet id carries a new message.
+	pub.send(newPublish(7, "q2", 2, "next"))
+
+	var got []string
+	for {
+		m := sub.readPublish(300 * time.Millisecond)
+		if m == nil {
+			break
+		}
+		got = append(got, string(m.Payload))
+	}
+	if len(got) != 2 || got[0] != "once" || got[1] != "next" {
+		t.Fatalf("subscriber got %q, want [once next]", got)
+	}
+}
+
+func TestExpiredInflight(t *testing.T) {
+	s := newTestServer(t, nil)
+	connect := func() *testClient {
+		m := newConnect("sub", false)
+		m.ProtocolVersion = packets.Version5
+		m.Properties = &packets.Properties{SessionExpiryInterval: packets.Uint32(60), ReceiveMaximum: packets.Uint16(1)}
+		c, connack := connectTo(t, s, m)
+		if connack == nil || connack.ReturnCode != packets.Accepted {
+			t.Fatalf("CONNECT refused: %v", connack)
+		}
+		return c
+	}
+	sub := connect()
+	sub.subscribe(1, "exp", 1)
+	pm := newConnect("pub", true)
+	pm.ProtocolVersion = packets.Version5
+	pub, _ := connectTo(t, s, pm)
+
+	// The first message fills the window of one and is left unacknowledged;
+	// the second waits for room.
+	m := newPublish(1, "exp", 1, "expires")
+	m.Properties = &packets.Properties{MessageExpiry: packets.Uint32(1)}
+	pub.send(m)
+	if p := sub.readPublish(2 * time.Second); p == nil || string(p.Payload) != "expires" {
+		t.Fatalf("got %v, want the expiring message", p)
+	}
+	pub.send(newPublish(2, "exp", 1, "lasts"))
+	if p := sub.readPublish(300 * time.Millisecond); p != nil {
+		t.Fatalf("got %q beyond the receive maximum", p.Payload)
+	}
+	sub.conn.Close()
+
+	// Once the first has expired, it is dropped rather than sent again,
+	// and makes room for the second.
+	time.Sleep(1100 * time.Millisecond)
+	sub = connect()
+	p := sub.readPublish(2 * time.Second)
+	if p == nil || string(p.Payload) != "lasts" {
+		t.Fatalf("got %v, want the message that lasts", p)
+	}
+	ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	ack.PacketID = p.PacketID
+	sub.send(ack)
+	if p := sub.readPublish(300 * time.Millisecond); p != nil {
+		t.Fatalf("got %q again", p.Payload)
+	}
+}
+
+func TestTakeoverWill(t *testing.T) {
+	s := newTestServer(t, nil)
+	watch, _ := connectTo(t, s, newConnect("watch", true))
+	watch.subscribe(1, "will", 0)
+
+	connect := func(clean bool) (*testClient, *packets.ConnackPacket) {
+		m := newConnect("willed", clean)
+		m.ProtocolVersion = packets.Version5
+		m.Properties = &packets.Properties{SessionExpiryInterval: packets.Uint32(60)}
+		m.WillFlag, m.WillTopic, m.WillMessage = true, "will", []byte("gone")
+		m.WillProperties = &packets.Properties{WillDelayInterval: packets.Uint32(30)}
+		return connectTo(t, s, m)
+	}
+	expectWill := func(want bool, when string) {
+		t.Helper()
+		p := watch.readPublish(500 * time.Millisecond)
+		if want && (p == nil || string(p.Payload) != "gone") {
+			t.Fatalf("%s: got %v, want the will", when, p)
+		}
+		if !want && p != nil {
+			t.Fatalf("%s: got %q, want no will", when, p.Payload)
+		}
+	}
+
+	// A clean start takes over the connection, ending its session, so
+	// the will is published without waiting for its delay.
+	old, _ := connect(true)
+	cur, _ := connect(true)
+	expectWill(true, "clean start over a live connection")
+	if m := old.read(time.Second); m != nil {
+		if _, ok := m.(*packets.DisconnectPacket); !ok {
+			t.Fatalf("old connection got %T", m)
+		}
+	}
+
+	// The same once the connection has gone and the will waits.
+	cur.conn.Close()
+	expectWill(false, "within the will delay")
+	connect(true)
+	expectWill(true, "clean start over a detached session")
+
+	// Resuming the session cancels the will instead.
+	connect(false)
+	expectWill(false, "resumed session")
+}
+
+func TestQueueLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(*Server)
+		policy QueuePolicy
+		want   string
+	}{
+		{"messages, reject new", func(s *Server) { s.MaxQueuedMessages = 3 }, QueueRejectNew, "m1 m2 m3"},
+		{"messages, drop oldest", func(s *Server) { s.MaxQueuedMessages = 3 }, QueueDropOldest, "m3 m4 m5"},
+		// A message takes 2 bytes of topic and 2 of payload.
+		{"bytes, reject new", func(s *Server) { s.MaxQueuedBytes = 8 }, QueueRejectNew, "m1 m2"},
+		{"bytes, drop oldest", func(s *Server) { s.MaxQueuedBytes = 8 }, QueueDropOldest, "m4 m5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(s *Server) {
+				tt.setup(s)
+				s.QueuePolicy = tt.policy
+			})
+			sub, _ := connectTo(t, s, newConnect("sub", false))
+			sub.subscribe(1, "qq", 1)
+			sub.conn.Close()
+
+			// The client is away while five messages come in.
+			pub, _ := connectTo(t, s, newConnect("pub", true))
+			for i := 1; i <= 5; i++ {
+				pub.send(newPublish(uint16(i), "qq", 1, "m"+strconv.Itoa(i)))
+				pub.read(2 * time.Second)
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			sub, _ = connectTo(t, s, newConnect("sub", false))
+			var got []string
+			for {
+				m := sub.readPublish(300 * time.Millisecond)
+				if m == nil {
+					break
+				}
+				got = append(got, string(m.Payload))
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Fatalf("got %q, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueQuotaExceeded(t *testing.T) {
+	s := newTestServer(t, func(s *Server) {
+		s.MaxQueuedMessages = 1
+		s.QueuePolicy = QueueRejectNew
+	})
+	connect := func() *testClient {
+		m := newConnect("sub", false)
+		m.ProtocolVersion = packets.Version5
+		m.Properties = &packets.Properties{SessionExpiryInterval: packets.Uint32(60), ReceiveMaximum: packets.Uint16(1)}
+		c, _ := connectTo(t, s, m)
+		return c
+	}
+	sub := connect()
+	sub.subscribe(1, "qq", 1)
+	pub, _ := connectTo(t, s, newConnect("pub", true))
+
+	// One message in flight, unacknowledged, one queued: an MQTT 5 client
+	// that cannot keep up with the third is told so.
+	for i := 1; i <= 3; i++ {
+		pub.send(newPublish(uint16(i), "qq", 1, "m"+strconv.Itoa(i)))
+		pub.read(2 * time.Second)
+	}
+	var d *packets.DisconnectPacket
+	for d == nil {
+		m := sub.read(2 * time.Second)
+		if m == nil {
+			t.Fatal("client not disconnected")
+		}
+		d, _ = m.(*packets.DisconnectPacket)
+	}
+	if d.ReasonCode != packets.ReasonQuotaExceeded {
+		t.Fatalf("DISCONNECT %#x, want %#x", d.ReasonCode, packets.ReasonQuotaExceeded)
+	}
+
+	// Coming back, it gets what was kept.
+	sub = connect()
+	var got []string
+	for {
+		m := sub.readPublish(300 * time.Millisecond)
+		if m == nil {
+			break
+		}
+		got = append(got, string(m.Payload))
+		ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		ack.PacketID = m.PacketID
+		sub.send(ack)
+	}
+	if strings.Join(got, " ") != "m1 m2" {
+		t.Fatalf("got %q after reconnecting, want m1 m2", got)
+	}
+}
+
+func TestRedeliverDup(t *testing.T) {
+	s := newTestServer(t, func(s *Server) { s.RetryInterval = 200 * time.Millisecond })
+	sub, _ := connectTo(t, s, newConnect("sub", false))
+	sub.subscribe(1, "t", 1)
+	pub, _ := connectTo(t, s, newConnect("pub", true))
+	pub.send(newPublish(1, "t", 1, "m"))
+
+	first := sub.readPublish(2 * time.Second)
+	if first == nil || first.Dup || first.Qos != 1 {
+		t.Fatalf("got %v, want the message at QoS 1", first)
+	}
+	// Unacknowledged after the RetryInterval, it is sent again as a
+	// duplicate with the same packet id.
+	p := sub.readPublish(2 * time.Second)
+	if p == nil || !p.Dup || p.PacketID != first.PacketID || string(p.Payload) != "m" {
+		t.Fatalf("got %v, want packet %d again with DUP", p, first.PacketID)
+	}
+
+	// And again when the client comes back, until acknowledged.
+	sub.conn.Close()
+	sub, connack := connectTo(t, s, newConnect("sub", false))
+	if connack == nil || !connack.SessionPresent {
+		t.Fatalf("got %v, want the session kept", connack)
+	}
+	p = sub.readPublish(2 * time.Second)
+	if p == nil || !p.Dup || p.PacketID != first.PacketID {
+		t.Fatalf("got %v after reconnecting, want packet %d again with DUP", p, first.PacketID)
+	}
+	ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	ack.PacketID = p.PacketID
+	sub.send(ack)
+	if p := sub.readPublish(time.Second); p != nil {
+		t.Fatalf("got %v after PUBACK", p)
+	}
+}
+
+func TestQoSDowngrade(t *testing.T) {
+	s := newTestServer(t, func(s *Server) { s.MaxQoS = 1 })
+	subs := make([]*testClient, 3)
+	for qos := range subs {
+		subs[qos], _ = connectTo(t, s, newConnect("sub"+strconv.Itoa(qos), true))
+		sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		sub.PacketID, sub.Topics, sub.Qoss = 1, []string{"t"}, []byte{byte(qos)}
+		subs[qos].send(sub)
+		sa, ok := subs[qos].read(2 * time.Second).(*packets.SubackPacket)
+		want := byte(qos)
+		if want > 1 {
+			want = 1
+		}
+		if !ok || sa.GrantedQoss[0] != want {
+			t.Fatalf("SUBACK %v for QoS %d, want QoS %d granted", sa, qos, want)
+		}
+	}
+
+	// Each subscriber gets each message at the lowest of the QoS it was
+	// published with, the QoS of the subscription and MaxQoS.
+	pub, _ := connectTo(t, s, newConnect("pub", true))
+	for qos := byte(0); qos <= 2; qos++ {
+		pub.send(newPublish(uint16(qos+1), "t", qos, strconv.Itoa(int(qos))))
+		switch qos {
+		case 1:
+			pub.read(2 * time.Second)
+		case 2:
+			pub.read(2 * time.Second)
+			rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			rel.PacketID = 3
+			pub.send(rel)
+			pub.read(2 * time.Second)
+		}
+		for subQoS, c := range subs {
+			p := c.readPublish(2 * time.Second)
+			want := qos
+			if byte(subQoS) < want {
+				want = byte(subQoS)
+			}
+			if want > 1 {
+				want = 1
+			}
+			if p == nil || string(p.Payload) != strconv.Itoa(int(qos)) || p.Qos != want {
+				t.Fatalf("QoS %d message to QoS %d subscriber: got %v, want QoS %d", qos, subQoS, p, want)
+			}
+		}
+	}
+}
+
+func TestMaximumQoS(t *testing.T) {
+	for _, max := range []byte{0, 1, 2} {
+		s := newTestServer(t, func(s *Server) { s.MaxQoS = max })
+		m := newConnect("c", true)
+		m.ProtocolVersion = packets.Version5
+		c, connack := connectTo(t, s, m)
+		if connack == nil || connack.ReturnCode != packets.Accepted {
+			t.Fatalf("MaxQoS %d: CONNECT refused: %v", max, connack)
+		}
+		// It is only told when less than 2, the default of MQTT 5.
+		got := connack.Properties.MaximumQos
+		if max == 2 && got != nil || max < 2 && (got == nil || *got != max) {
+			t.Fatalf("MaxQoS %d: CONNACK with Maximum QoS %v", max, got)
+		}
+		if max == 2 {
+			continue
+		}
+
+		// A PUBLISH above it disconnects the client.
+		c.send(newPublish(1, "t", max+1, "too high"))
+		d, ok := c.read(2 * time.Second).(*packets.DisconnectPacket)
+		if !ok || d.ReasonCode != packets.ReasonQoSNotSupported {
+			t.Fatalf("MaxQoS %d: got %v, want a DISCONNECT with QoS not supported", max, d)
+		}
+	}
+}
+
+func TestOverlappingSubscriptions(t *testing.T) {
+	s := newTestServer(t, nil)
+	m := newConnect("sub", true)
+	m.ProtocolVersion = packets.Version5
+	sub, _ := connectTo(t, s, m)
+	filters := []struct {
+		filter string
+		qos    byte
+		id     int
+		opts   packets.SubscriptionOptions
+	}{
+		{"a/+", 0, 1, packets.SubscriptionOptions{}},
+		{"a/#", 1, 2, packets.SubscriptionOptions{}},
+		{"a/b", 0, 0, packets.SubscriptionOptions{RetainAsPublished: true}},
+		{"x/#", 2, 3, packets.SubscriptionOptions{}},
+	}
+	for i, f := range filters {
+		m := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		m.PacketID = uint16(i + 1)
+		m.Topics, m.Qoss = []string{f.filter}, []byte{f.qos}
+		m.Options = []packets.SubscriptionOptions{f.opts}
+		m.Properties = &packets.Properties{}
+		if f.id > 0 {
+			m.Properties.SubscriptionIdentifier = []int{f.id}
+		}
+		sub.send(m)
+		if _, ok := sub.read(2 * time.Second).(*packets.SubackPacket); !ok {
+			t.Fatalf("no SUBACK for %s", f.filter)
+		}
+	}
+	plain, _ := connectTo(t, s, newConnect("plain", true))
+	plain.subscribe(1, "a/+", 0)
+	plain.subscribe(2, "a/b", 1)
+
+	// A single copy, at the highest QoS, with the ids of all the matching
+	// subscriptions, and retained as published for one of them.
+	pub, _ := connectTo(t, s, newConnect("pub", true))
+	p := newPublish(1, "a/b", 1, "once")
+	p.Retain = true
+	pub.send(p)
+	got := sub.readPublish(2 * time.Second)
+	if got == nil || got.Qos != 1 || !got.Retain || got.Properties == nil {
+		t.Fatalf("got %v, want one copy at QoS 1, retained", got)
+	}
+	ids := append([]int(nil), got.Properties.SubscriptionIdentifier...)
+	if len(ids) != 2 || ids[0]+ids[1] != 3 || ids[0] == ids[1] {
+		t.Fatalf("subscription identifiers %v, want 1 and 2", ids)
+	}
+	if got := plain.readPublish(2 * time.Second); got == nil || got.Qos != 1 {
+		t.Fatalf("got %v, want one copy at QoS 1", got)
+	}
+	if p := sub.readPublish(300 * time.Millisecond); p != nil {
+		t.Fatalf("got a second copy %v", p)
+	}
+	if p := plain.readPublish(300 * time.Millisecond); p != nil {
+		t.Fatalf("got a second copy %v", p)
+	}
+}
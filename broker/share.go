@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+)
+
+// A SharePolicy decides which member of a shared subscription receives a
+// message.
+type SharePolicy int
+
+const (
+	ShareRoundRobin SharePolicy = iota // members take turns
+	ShareRandom                        // a member picked at random
+	ShareHash                          // the same member for each publishing client
+)
+
+// A shareGroup holds the members of a shared subscription, each message
+// going to one of them only. The members slice is copied on write, so it
+// can be used after the trie is unlocked.
+type shareGroup struct {
+	next    uint32 // round-robin position, accessed atomically
+	members []subscription
+}
+
+// A share is a shared subscription matching a topic, with its members at
+// the time of the match.
+type share struct {
+	g       *shareGroup
+	members []subscription
+}
+
+// parseShare splits a shared subscription, "$share/<group>/<filter>" or
+// the legacy "$queue/<filter>", into its group and filter. All $queue
+// subscribers form a single group. ok is false for other topic filters.
+func parseShare(topic string) (group, filter string, ok bool) {
+	if strings.HasPrefix(topic, "$queue/") {
+		return "$queue", topic[len("$queue/"):], true
+	}
+	if !strings.HasPrefix(topic, "$share/") {
+		return "", "", false
+	}
+	parts := strings.SplitN(topic[len("$share/"):], "/", 2)
+	if len(parts) != 2 {
+		return parts[0], "", true
+	}
+	return parts[0], parts[1], true
+}
+
+func (g *shareGroup) add(sub subscription) {
+	members := make([]subscription, 0, len(g.members)+1)
+	for _, m := range g.members {
+		if m.s != sub.s {
+			members = append(members, m)
+		}
+	}
+	g.members = append(members, sub)
+}
+
+func (g *shareGroup) remove(sess *session) {
+	members := make([]subscription, 0, len(g.members))
+	for _, m := range g.members {
+		if m.s != sess {
+			members = append(members, m)
+		}
+	}
+	g.members = members
+}
+
+// Deliver a message to one member of a shared subscription. The member
+// is picked according to the server's SharePolicy; when its client is
+// offline or cannot keep up, the next ready member gets the message
+// instead. If no member is ready, the picked one gets it anyway.
+func (s *subscriptions) deliverShared(sh share, p post) {
+	n := len(sh.members)
+	if n == 0 {
+		return
+	}
+
+	var first int
+	switch s.svr.SharePolicy {
+	case ShareRandom:
+		first = rand.Intn(n)
+	case ShareHash:
+		h := fnv.New32a()
+		if p.c != nil {
+			h.Write([]byte(p.c.clientid))
+		} else {
+			h.Write([]byte(p.m.TopicName))
+		}
+		first = int(h.Sum32() % uint32(n))
+	default:
+		first = int(atomic.AddUint32(&sh.g.next, 1) % uint32(n))
+	}
+
+	for i := 0; i < n; i++ {
+		sub := sh.members[(first+i)%n]
+		if sub.s.ready() {
+			sub.s.deliver(p.message(sub), sub.qos, sub.ids, p.expires)
+			return
+		}
+	}
+	sub := sh.members[first]
+	sub.s.deliver(p.message(sub), sub.qos, sub.ids, p.expires)
+}
@@ -0,0 +1,209 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+func TestParseShare(t *testing.T) {
+	tests := []struct {
+		topic, group, filter string
+		ok, valid            bool
+	}{
+		{"$share/g/a/b", "g", "a/b", true, true},
+		{"$share/g/#", "g", "#", true, true},
+		{"$share/g/a/+/c", "g", "a/+/c", true, true},
+		{"$queue/a/b", "$queue", "a/b", true, true},
+		{"$share/g", "g", "", true, false},
+		{"$share/g/", "g", "", true, false},
+		{"$share//a", "", "a", true, false},
+		{"$share/+/a", "+", "a", true, false},
+		{"$share/#/a", "#", "a", true, false},
+		{"$share/g/a/#/b", "g", "a/#/b", true, false},
+		{"a/b", "", "", false, true},
+		{"$sharex/g/a", "", "", false, true},
+		{"$SYS/a", "", "", false, true},
+	}
+	for _, tt := range tests {
+		group, filter, ok := parseShare(tt.topic)
+		if group != tt.group || filter != tt.filter || ok != tt.ok {
+			t.Errorf("parseShare(%q) = %q, %q, %v, want %q, %q, %v", tt.topic, group, filter, ok, tt.group, tt.filter, tt.ok)
+		}
+		if valid := validFilter(tt.topic); valid != tt.valid {
+			t.Errorf("validFilter(%q) = %v, want %v", tt.topic, valid, tt.valid)
+		}
+	}
+}
+
+// countPublishes reads the messages a client gets until none come for a
+// while, counting them by payload.
+func countPublishes(c *testClient) map[string]int {
+	got := make(map[string]int)
+	for p := c.readPublish(300 * time.Millisecond); p != nil; p = c.readPublish(300 * time.Millisecond) {
+		got[string(p.Payload)]++
+	}
+	return got
+}
+
+// shareMembers connects n clients subscribed to a shared subscription.
+func shareMembers(t *testing.T, s *Server, filter string, n int) []*testClient {
+	members := make([]*testClient, n)
+	for i := range members {
+		members[i], _ = connectTo(t, s, newConnect(fmt.Sprintf("member%d", i), true))
+		members[i].subscribe(1, filter, 0)
+	}
+	return members
+}
+
+func TestSharedRoundRobin(t *testing.T) {
+	s := newTestServer(t, nil)
+	members := shareMembers(t, s, "$share/g/t/+", 3)
+	other, _ := connectTo(t, s, newConnect("other", true))
+	other.subscribe(1, "$share/h/t/#", 0)
+	plain, _ := connectTo(t, s, newConnect("plain", true))
+	plain.subscribe(1, "t/+", 0)
+
+	pub, _ := connectTo(t, s, newConnect("pub", true))
+	for i := 0; i < 6; i++ {
+		pub.send(newPublish(0, "t/x", 0, fmt.Sprint(i)))
+	}
+
+	// Members take turns; every group, and every plain subscriber, gets
+	// each message once.
+	seen := make(map[string]int)
+	for i, c := range members {
+		got := countPublishes(c)
+		n := 0
+		for payload, count := range got {
+			seen[payload] += count
+			n += count
+		}
+		if n != 2 {
+			t.Errorf("member %d got %d messages %v, want 2", i, n, got)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		if seen[fmt.Sprint(i)] != 1 {
+			t.Errorf("message %d delivered %d times in the group", i, seen[fmt.Sprint(i)])
+		}
+	}
+	if got := countPublishes(other); len(got) != 6 {
+		t.Errorf("other group got %v, want all 6", got)
+	}
+	if got := countPublishes(plain); len(got) != 6 {
+		t.Errorf("plain subscriber got %v, want all 6", got)
+	}
+}
+
+func TestSharedRandom(t *testing.T) {
+	s := newTestServer(t, func(s *Server) { s.SharePolicy = ShareRandom })
+	members := shareMembers(t, s, "$share/g/t", 3)
+	pub, _ := connectTo(t, s, newConnect("pub", true))
+	for i := 0; i < 30; i++ {
+		pub.send(newPublish(0, "t", 0, fmt.Sprint(i)))
+	}
+
+	seen := make(map[string]int)
+	for _, c := range members {
+		for payload, count := range countPublishes(c) {
+			seen[payload] += count
+		}
+	}
+	for i := 0; i < 30; i++ {
+		if seen[fmt.Sprint(i)] != 1 {
+			t.Errorf("message %d delivered %d times in the group", i, seen[fmt.Sprint(i)])
+		}
+	}
+}
+
+func TestSharedHash(t *testing.T) {
+	s := newTestServer(t, func(s *Server) { s.SharePolicy = ShareHash })
+	members := shareMembers(t, s, "$share/g/t", 3)
+	for _, id := range []string{"pub-a", "pub-b", "pub-c", "pub-d"} {
+		pub, _ := connectTo(t, s, newConnect(id, true))
+		for i := 0; i < 5; i++ {
+			pub.send(newPublish(0, "t", 0, id))
+		}
+	}
+
+	// Each publisher's messages all go to the same member.
+	by := make(map[string]int)
+	for i, c := range members {
+		for id, count := range countPublishes(c) {
+			if count != 5 {
+				t.Errorf("member %d got %d of the 5 messages of %s", i, count, id)
+			}
+			by[id]++
+		}
+	}
+	for _, id := range []string{"pub-a", "pub-b", "pub-c", "pub-d"} {
+		if by[id] != 1 {
+			t.Errorf("messages of %s went to %d members, want 1", id, by[id])
+		}
+	}
+}
+
+func TestSharedMemberDisconnected(t *testing.T) {
+	s := newTestServer(t, nil)
+	away, _ := connectTo(t, s, newConnect("away", false))
+	away.subscribe(1, "$share/g/t", 1)
+	here, _ := connectTo(t, s, newConnect("here", true))
+	here.subscribe(1, "$share/g/t", 1)
+
+	// The member whose client is gone keeps its session and its place in
+	// the group, but the others get the messages in its stead.
+	s.Kick("away")
+	for deadline := time.Now().Add(2 * time.Second); s.sessions.conn("away") != nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("client still connected after Kick")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pub, _ := connectTo(t, s, newConnect("pub", true))
+	for i := 0; i < 4; i++ {
+		pub.send(newPublish(uint16(i+1), "t", 1, fmt.Sprint(i)))
+	}
+	var got int
+	for p := here.readPublish(time.Second); p != nil; p = here.readPublish(300 * time.Millisecond) {
+		ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		ack.PacketID = p.PacketID
+		here.send(ack)
+		got++
+	}
+	if got != 4 {
+		t.Fatalf("connected member got %d messages, want 4", got)
+	}
+
+	away, connack := connectTo(t, s, newConnect("away", false))
+	if connack == nil || !connack.SessionPresent {
+		t.Fatalf("got %v, want the session kept", connack)
+	}
+	if p := away.readPublish(300 * time.Millisecond); p != nil {
+		t.Fatalf("disconnected member got %q queued", p.Payload)
+	}
+}
+
+func TestSharedNoRetained(t *testing.T) {
+	s := newTestServer(t, nil)
+	pub, _ := connectTo(t, s, newConnect("pub", true))
+	r := newPublish(1, "t", 1, "retained")
+	r.Retain = true
+	pub.send(r)
+	if _, ok := pub.read(2 * time.Second).(*packets.PubackPacket); !ok {
+		t.Fatal("no PUBACK")
+	}
+
+	shared, _ := connectTo(t, s, newConnect("shared", true))
+	shared.subscribe(1, "$share/g/t", 1)
+	if p := shared.readPublish(300 * time.Millisecond); p != nil {
+		t.Fatalf("shared subscription got the retained %q", p.Payload)
+	}
+	plain, _ := connectTo(t, s, newConnect("plain", true))
+	plain.subscribe(1, "t", 1)
+	if p := plain.readPublish(time.Second); p == nil || !p.Retain {
+		t.Fatalf("got %v, want the retained message", p)
+	}
+}
@@ -0,0 +1,300 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// SnapshotVersion is the version of the snapshot format written by
+// Server.Snapshot. ReadSnapshot reads this version and the older ones.
+const SnapshotVersion = 1
+
+// A Snapshot is the state a Server keeps in its Store: the persistent
+// sessions, with their subscriptions and queued and in-flight messages,
+// and the retained messages.
+//
+// A snapshot is written as the 8 bytes "MQTTSNAP", the format version as a
+// big-endian uint16, and the time it was taken as big-endian int64 Unix
+// nanoseconds. Then come records, framed as those of the WAL: an
+// operation byte, the length of the body as a big-endian uint32, the CRC32
+// (IEEE) of the body as a big-endian uint32, and the body. Integers are
+// big-endian, strings are prefixed with their length as a uint16, and
+// expiry times are int64 Unix nanoseconds, 0 for never.
+//
+//	'S' (session):      client id, Session Expiry Interval as uint32
+//	'U' (subscription): client id, topic filter, granted QoS byte,
+//	                    options byte (No Local in bit 2, Retain As
+//	                    Published in bit 3, Retain Handling in bits 4-5),
+//	                    Subscription Identifier as uint32
+//	'Q' (message):      client id, id as uint64, packet id as uint16,
+//	                    1 if PUBREC was received else 0, expiry time,
+//	                    the message as an MQTT 5 PUBLISH
+//	'R' (retained):     expiry time, the message as an MQTT 5 PUBLISH
+//	'E' (end):          the number of records before it, as uint64
+//
+// The subscriptions and messages of a session follow its 'S' record. The
+// 'E' record is last; a snapshot without one was cut short.
+type Snapshot struct {
+	Version  uint16
+	Taken    time.Time
+	Sessions []SnapshotSession // ordered by client id
+	Retained []Retained        // ordered by topic
+}
+
+// A SnapshotSession is a session in a Snapshot.
+type SnapshotSession struct {
+	StoredSession
+	Subscriptions []StoredSubscription // ordered by topic filter
+	Messages      []StoredMessage      // ordered by id
+}
+
+var snapshotMagic = []byte("MQTTSNAP")
+
+const (
+	snapshotOpRetained = 'R'
+	snapshotOpEnd      = 'E'
+)
+
+// Snapshot writes the sessions and retained messages in the Store to w,
+// in the format described by Snapshot. It may be called while the server
+// runs: each session is then as it was at some point while Snapshot ran,
+// but they are not all taken at the same instant.
+func (s *Server) Snapshot(w io.Writer) error {
+	snap, err := takeSnapshot(s.Store)
+	if err != nil {
+		return err
+	}
+	return snap.write(w)
+}
+
+// Restore reads a snapshot written by Snapshot from r, and writes it to
+// the Store: a session in the snapshot replaces the one of the same client
+// id, and a retained message the one of the same topic. Whatever else the
+// Store holds is kept. The snapshot is read in full before anything is
+// written, so a bad snapshot leaves the Store as it was.
+//
+// Restore must be called before Start, which loads what it restored.
+func (s *Server) Restore(r io.Reader) error {
+	if atomic.LoadInt32(&s.started) != 0 {
+		return errors.New("restore after the server started")
+	}
+	snap, err := ReadSnapshot(r)
+	if err != nil {
+		return err
+	}
+	return snap.restore(s.Store)
+}
+
+func takeSnapshot(st Store) (*Snapshot, error) {
+	snap := &Snapshot{Version: SnapshotVersion, Taken: time.Now()}
+	err := st.Sessions(func(ss StoredSession) bool {
+		snap.Sessions = append(snap.Sessions, SnapshotSession{StoredSession: ss})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(snap.Sessions, func(i, j int) bool {
+		return snap.Sessions[i].ClientID < snap.Sessions[j].ClientID
+	})
+	for i := range snap.Sessions {
+		ss := &snap.Sessions[i]
+		if ss.Subscriptions, err = st.Subscriptions(ss.ClientID); err != nil {
+			return nil, err
+		}
+		if ss.Messages, err = st.Messages(ss.ClientID); err != nil {
+			return nil, err
+		}
+	}
+
+	err = st.Iterate(func(r Retained) bool {
+		snap.Retained = append(snap.Retained, r)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(snap.Retained, func(i, j int) bool {
+		return snap.Retained[i].Message.TopicName < snap.Retained[j].Message.TopicName
+	})
+	return snap, nil
+}
+
+func (snap *Snapshot) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.Write(snapshotMagic)
+	binary.Write(bw, binary.BigEndian, uint16(SnapshotVersion))
+	binary.Write(bw, binary.BigEndian, snap.Taken.UnixNano())
+
+	var n uint64
+	write := func(op byte, body []byte) error {
+		n++
+		return writeRecord(bw, op, body)
+	}
+	for _, ss := range snap.Sessions {
+		if err := write(walOpSession, sessionRecord(ss.ClientID, ss.Expiry).Bytes()); err != nil {
+			return err
+		}
+		for _, sub := range ss.Subscriptions {
+			if err := write(walOpSubscribe, subscriptionRecord(ss.ClientID, sub).Bytes()); err != nil {
+				return err
+			}
+		}
+		for _, msg := range ss.Messages {
+			e, err := messageRecord(walOpMessage, ss.ClientID, msg)
+			if err != nil {
+				return err
+			}
+			if err := write(walOpMessage, e.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range snap.Retained {
+		body, err := encodeRetained(r)
+		if err != nil {
+			return err
+		}
+		if err := write(snapshotOpRetained, body); err != nil {
+			return err
+		}
+	}
+
+	e := &walEncoder{}
+	e.write(n)
+	if err := writeRecord(bw, snapshotOpEnd, e.Bytes()); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ReadSnapshot reads a snapshot written by Server.Snapshot, so that it can
+// be inspected without a Server.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, snapshotMagic) {
+		return nil, errors.New("not a snapshot")
+	}
+	snap := &Snapshot{}
+	var taken int64
+	if err := binary.Read(br, binary.BigEndian, &snap.Version); err != nil {
+		return nil, err
+	}
+	if snap.Version == 0 || snap.Version > SnapshotVersion {
+		return nil, fmt.Errorf("unknown snapshot version %d", snap.Version)
+	}
+	if err := binary.Read(br, binary.BigEndian, &taken); err != nil {
+		return nil, err
+	}
+	snap.Taken = time.Unix(0, taken)
+
+	var head [9]byte
+	for n := uint64(0); ; n++ {
+		if _, err := io.ReadFull(br, head[:]); err != nil {
+			return nil, errors.New("snapshot cut short")
+		}
+		size := binary.BigEndian.Uint32(head[1:])
+		if size > walRecordMax {
+			return nil, fmt.Errorf("record %d too large", n)
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(br, body); err != nil {
+			return nil, errors.New("snapshot cut short")
+		}
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(head[5:]) {
+			return nil, fmt.Errorf("record %d: bad checksum", n)
+		}
+		if head[0] == snapshotOpEnd {
+			var count uint64
+			d := &walDecoder{r: bytes.NewReader(body)}
+			d.read(&count)
+			if d.err != nil || count != n {
+				return nil, fmt.Errorf("end record counts %d records, not %d", count, n)
+			}
+			return snap, nil
+		}
+		if err := snap.apply(head[0], body); err != nil {
+			return nil, fmt.Errorf("record %d: %s", n, err)
+		}
+	}
+}
+
+// Add a record, other than the end, to the snapshot.
+func (snap *Snapshot) apply(op byte, body []byte) error {
+	if op == snapshotOpRetained {
+		r, err := decodeRetained(body)
+		if err != nil {
+			return err
+		}
+		snap.Retained = append(snap.Retained, r)
+		return nil
+	}
+
+	d := &walDecoder{r: bytes.NewReader(body)}
+	clientid := d.string()
+	if op == walOpSession {
+		var expiry uint32
+		d.read(&expiry)
+		snap.Sessions = append(snap.Sessions, SnapshotSession{
+			StoredSession: StoredSession{ClientID: clientid, Expiry: expiry},
+		})
+		return d.err
+	}
+	var ss *SnapshotSession
+	if i := len(snap.Sessions) - 1; i >= 0 && snap.Sessions[i].ClientID == clientid {
+		ss = &snap.Sessions[i]
+	}
+	switch op {
+	case walOpSubscribe:
+		sub := d.subscription()
+		if ss == nil {
+			return fmt.Errorf("subscription of %q outside its session", clientid)
+		}
+		ss.Subscriptions = append(ss.Subscriptions, sub)
+	case walOpMessage:
+		msg := d.fullMessage()
+		if ss == nil {
+			return fmt.Errorf("message of %q outside its session", clientid)
+		}
+		ss.Messages = append(ss.Messages, msg)
+	default:
+		return fmt.Errorf("unknown record %q", op)
+	}
+	return d.err
+}
+
+func (snap *Snapshot) restore(st Store) error {
+	for _, ss := range snap.Sessions {
+		if err := st.DeleteSession(ss.ClientID); err != nil {
+			return err
+		}
+		if err := st.PutSession(ss.StoredSession); err != nil {
+			return err
+		}
+		for _, sub := range ss.Subscriptions {
+			if err := st.PutSubscription(ss.ClientID, sub); err != nil {
+				return err
+			}
+		}
+		for _, msg := range ss.Messages {
+			if err := st.PutMessage(ss.ClientID, msg); err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range snap.Retained {
+		if err := st.Put(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
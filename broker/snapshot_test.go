@@ -0,0 +1,161 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+// fillStore puts two sessions, one with a subscription, a queued and an
+// in-flight message, and a retained message in a Store.
+func fillStore(t *testing.T, st Store) {
+	t.Helper()
+	expires := time.Unix(0, time.Now().Add(time.Hour).UnixNano())
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(st.PutSession(StoredSession{ClientID: "a", Expiry: 60}))
+	check(st.PutSubscription("a", StoredSubscription{
+		Filter:     "x/#",
+		QoS:        1,
+		Options:    packets.SubscriptionOptions{NoLocal: true, RetainAsPublished: true, RetainHandling: 2},
+		Identifier: 5,
+	}))
+	check(st.PutMessage("a", StoredMessage{ID: 1, Message: newPublish(0, "x/queued", 1, "q"), Expires: expires}))
+	check(st.PutMessage("a", StoredMessage{ID: 2, Message: newPublish(0, "x/sent", 2, "s"), PacketID: 7, Pubrel: true}))
+	check(st.PutSession(StoredSession{ClientID: "b", Expiry: neverExpire}))
+	r := newPublish(0, "status", 1, "up")
+	r.Retain = true
+	check(st.Put(Retained{Message: r, Expires: expires}))
+}
+
+// describe lists what a Store holds, one line per item.
+func describe(t *testing.T, st Store) []string {
+	t.Helper()
+	snap, err := takeSnapshot(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, ss := range snap.Sessions {
+		lines = append(lines, fmt.Sprintf("session %s %d", ss.ClientID, ss.Expiry))
+		for _, sub := range ss.Subscriptions {
+			lines = append(lines, fmt.Sprintf("  sub %+v", sub))
+		}
+		for _, m := range ss.Messages {
+			lines = append(lines, fmt.Sprintf("  msg %d %s q%d %q packet %d pubrel %v expires %d",
+				m.ID, m.Message.TopicName, m.Message.Qos, m.Message.Payload, m.PacketID, m.Pubrel, m.Expires.UnixNano()))
+		}
+	}
+	for _, r := range snap.Retained {
+		lines = append(lines, fmt.Sprintf("retained %s q%d %q expires %d",
+			r.Message.TopicName, r.Message.Qos, r.Message.Payload, r.Expires.UnixNano()))
+	}
+	return lines
+}
+
+// A snapshot of the store filled by fillStore.
+func testSnapshot(t *testing.T) []byte {
+	t.Helper()
+	st := NewMemoryStore()
+	fillStore(t, st)
+	var b bytes.Buffer
+	if err := (&Server{Store: st}).Snapshot(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	src := NewMemoryStore()
+	fillStore(t, src)
+	var b bytes.Buffer
+	if err := (&Server{Store: src}).Snapshot(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	// A session of the snapshot replaces the one in the Store; the others
+	// are kept.
+	dst := NewMemoryStore()
+	dst.PutSession(StoredSession{ClientID: "a", Expiry: 1})
+	dst.PutSubscription("a", StoredSubscription{Filter: "old", QoS: 0})
+	dst.PutSession(StoredSession{ClientID: "c", Expiry: 10})
+	if err := (&Server{Store: dst}).Restore(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := describe(t, src)
+	n := len(want) - 1 // the retained message, after the sessions
+	want = append(want[:n:n], "session c 10", want[n])
+	got := describe(t, dst)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestRestoreAfterStart(t *testing.T) {
+	s := newTestServer(t, nil)
+	if err := s.Restore(bytes.NewReader(testSnapshot(t))); err == nil {
+		t.Fatal("restored into a running server")
+	}
+}
+
+func TestReadSnapshotErrors(t *testing.T) {
+	good := testSnapshot(t)
+	if _, err := ReadSnapshot(bytes.NewReader(good)); err != nil {
+		t.Fatal(err)
+	}
+	edit := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), good...))
+	}
+
+	tests := map[string][]byte{
+		"bad magic": edit(func(b []byte) []byte { b[0] = 'X'; return b }),
+		"unknown version": edit(func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[8:], SnapshotVersion+1)
+			return b
+		}),
+		"version 0": edit(func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[8:], 0)
+			return b
+		}),
+		"bad checksum": edit(func(b []byte) []byte { b[len(b)-20]++; return b }),
+		// The end record is last: 9 bytes of header and a uint64 count.
+		"wrong end count": edit(func(b []byte) []byte {
+			end := b[len(b)-17:]
+			binary.BigEndian.PutUint64(end[9:], binary.BigEndian.Uint64(end[9:])+1)
+			binary.BigEndian.PutUint32(end[5:], crc32.ChecksumIEEE(end[9:]))
+			return b
+		}),
+		"no end": good[:len(good)-17],
+	}
+	for name, b := range tests {
+		if _, err := ReadSnapshot(bytes.NewReader(b)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	// Cut short anywhere, it does not read.
+	for n := 0; n < len(good); n++ {
+		if _, err := ReadSnapshot(bytes.NewReader(good[:n])); err == nil {
+			t.Fatalf("cut to %d of %d bytes: no error", n, len(good))
+		}
+	}
+
+	// Nor does it restore, leaving the Store as it was.
+	st := NewMemoryStore()
+	st.PutSession(StoredSession{ClientID: "a", Expiry: 1})
+	if err := (&Server{Store: st}).Restore(bytes.NewReader(tests["wrong end count"])); err == nil {
+		t.Fatal("restored a bad snapshot")
+	}
+	if got := describe(t, st); !reflect.DeepEqual(got, []string{"session a 1"}) {
+		t.Fatalf("store changed by a failed Restore: %q", got)
+	}
+}
@@ -11,6 +11,7 @@ import (
 type stats struct {
 	recv       int64
 	sent       int64
+	dropped    int64
 	clients    int64
 	clientsMax int64
 	lastmsgs   int64
@@ -18,6 +19,7 @@ type stats struct {
 
 func (s *stats) messageRecv()      { atomic.AddInt64(&s.recv, 1) }
 func (s *stats) messageSend()      { atomic.AddInt64(&s.sent, 1) }
+func (s *stats) messageDrop()      { atomic.AddInt64(&s.dropped, 1) }
 func (s *stats) clientConnect()    { atomic.AddInt64(&s.clients, 1) }
 func (s *stats) clientDisconnect() { atomic.AddInt64(&s.clients, -1) }
 
@@ -44,6 +46,8 @@ func (s *stats) publish(sub *subscriptions, interval time.Duration) {
 		atomic.LoadInt64(&s.recv)))
 	sub.submit(nil, statsMessage("$SYS/broker/messages/sent",
 		atomic.LoadInt64(&s.sent)))
+	sub.submit(nil, statsMessage("$SYS/broker/messages/dropped",
+		atomic.LoadInt64(&s.dropped)))
 
 	msgs := atomic.LoadInt64(&s.recv) + atomic.LoadInt64(&s.sent)
 	msgpersec := (msgs - s.lastmsgs) / int64(interval/time.Second)
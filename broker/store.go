@@ -0,0 +1,287 @@
+package broker
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+// A Store keeps what a Server must not lose when it restarts: the
+// sessions that outlive their connection, with their subscriptions and
+// the QoS 1 and 2 messages queued or in flight for them, and the retained
+// messages. The Server writes every change through to its Store, and
+// reads it back when it starts.
+//
+// Implementations must be safe for concurrent use, and must not call back
+// into the Server. The Server keeps what it reads and writes in RAM as
+// well, so a Store need not be fast to read.
+type Store interface {
+	SessionStore
+	RetainStore
+}
+
+// A SessionStore is the part of a Store that keeps sessions.
+type SessionStore interface {
+	// PutSession stores a session, or changes its Session Expiry Interval,
+	// keeping its subscriptions and messages.
+	PutSession(s StoredSession) error
+
+	// DeleteSession removes the session of a client id, with its
+	// subscriptions and messages.
+	DeleteSession(clientid string) error
+
+	// Sessions calls f for each session, until f returns false. The store
+	// must not be modified from f.
+	Sessions(f func(StoredSession) bool) error
+
+	// PutSubscription stores a subscription of a session, replacing the
+	// one to the same topic filter. It does nothing if there is no
+	// session for the client id.
+	PutSubscription(clientid string, sub StoredSubscription) error
+
+	// DeleteSubscription removes the subscription of a session to a topic
+	// filter, if there is one.
+	DeleteSubscription(clientid string, filter string) error
+
+	// Subscriptions returns the subscriptions of a session.
+	Subscriptions(clientid string) ([]StoredSubscription, error)
+
+	// PutMessage stores a message of a session, replacing the one of the
+	// same id. It does nothing if there is no session for the client id.
+	PutMessage(clientid string, m StoredMessage) error
+
+	// DeleteMessage removes a message of a session, if there is one.
+	DeleteMessage(clientid string, id uint64) error
+
+	// Messages returns the messages of a session, ordered by id.
+	Messages(clientid string) ([]StoredMessage, error)
+}
+
+// A StoredSession is a session, as a Store keeps it.
+type StoredSession struct {
+	ClientID string
+	Expiry   uint32 // Session Expiry Interval, in seconds; 0xFFFFFFFF for never
+}
+
+// A StoredSubscription is a subscription of a session, as a Store keeps
+// it.
+type StoredSubscription struct {
+	Filter     string // topic filter, with its $share/group/ prefix if shared
+	QoS        byte   // granted
+	Options    packets.SubscriptionOptions
+	Identifier int // MQTT 5 Subscription Identifier; 0 if none
+}
+
+// A StoredMessage is a QoS 1 or 2 message of a session, as a Store keeps
+// it.
+type StoredMessage struct {
+	// ID orders the messages of a session, in the order they were given
+	// to it. It is never 0.
+	ID uint64
+
+	// The message, which must not be modified once stored. Its packet id
+	// does not count; PacketID does.
+	Message *packets.PublishPacket
+
+	// When the message expires, from its MQTT 5 Message Expiry Interval.
+	// Zero if it never does.
+	Expires time.Time
+
+	// The packet id the message was sent under, 0 while it is queued.
+	PacketID uint16
+
+	// True once the client has sent PUBREC for a QoS 2 message.
+	Pubrel bool
+}
+
+// NewStore returns a Store keeping sessions in one place, and retained
+// messages in another.
+func NewStore(sessions SessionStore, retain RetainStore) Store {
+	return struct {
+		SessionStore
+		RetainStore
+	}{sessions, retain}
+}
+
+// NewMemoryStore returns a Store that keeps everything in RAM, made of a
+// MemorySessionStore and a MemoryRetainStore. It is the Store a Server
+// uses unless told otherwise.
+func NewMemoryStore() Store {
+	return NewStore(NewMemorySessionStore(), NewMemoryRetainStore())
+}
+
+// A MemorySessionStore is a SessionStore that keeps sessions in RAM.
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*memorySession
+}
+
+// A memorySession is a session kept in RAM, by a MemorySessionStore or a
+// WAL.
+type memorySession struct {
+	expiry   uint32
+	subs     map[string]StoredSubscription
+	messages map[uint64]StoredMessage
+}
+
+func newMemorySession(expiry uint32) *memorySession {
+	return &memorySession{
+		expiry:   expiry,
+		subs:     make(map[string]StoredSubscription),
+		messages: make(map[uint64]StoredMessage),
+	}
+}
+
+// The subscriptions, ordered by topic filter.
+func (m *memorySession) subscriptions() []StoredSubscription {
+	list := make([]StoredSubscription, 0, len(m.subs))
+	for _, sub := range m.subs {
+		list = append(list, sub)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Filter < list[j].Filter })
+	return list
+}
+
+// The messages, ordered by id.
+func (m *memorySession) messageList() []StoredMessage {
+	list := make([]StoredMessage, 0, len(m.messages))
+	for _, msg := range m.messages {
+		list = append(list, msg)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// NewMemorySessionStore returns an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]*memorySession)}
+}
+
+// PutSession stores a session.
+func (s *MemorySessionStore) PutSession(ss StoredSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.sessions[ss.ClientID]; ok {
+		m.expiry = ss.Expiry
+		return nil
+	}
+	s.sessions[ss.ClientID] = newMemorySession(ss.Expiry)
+	return nil
+}
+
+// DeleteSession removes a session.
+func (s *MemorySessionStore) DeleteSession(clientid string) error {
+	s.mu.Lock()
+	delete(s.sessions, clientid)
+	s.mu.Unlock()
+	return nil
+}
+
+// Sessions calls f for each session.
+func (s *MemorySessionStore) Sessions(f func(StoredSession) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for clientid, m := range s.sessions {
+		if !f(StoredSession{ClientID: clientid, Expiry: m.expiry}) {
+			break
+		}
+	}
+	return nil
+}
+
+// PutSubscription stores a subscription of a session.
+func (s *MemorySessionStore) PutSubscription(clientid string, sub StoredSubscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.sessions[clientid]; ok {
+		m.subs[sub.Filter] = sub
+	}
+	return nil
+}
+
+// DeleteSubscription removes a subscription of a session.
+func (s *MemorySessionStore) DeleteSubscription(clientid string, filter string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.sessions[clientid]; ok {
+		delete(m.subs, filter)
+	}
+	return nil
+}
+
+// Subscriptions returns the subscriptions of a session.
+func (s *MemorySessionStore) Subscriptions(clientid string) ([]StoredSubscription, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.sessions[clientid]
+	if !ok {
+		return nil, nil
+	}
+	return m.subscriptions(), nil
+}
+
+// PutMessage stores a message of a session.
+func (s *MemorySessionStore) PutMessage(clientid string, msg StoredMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.sessions[clientid]; ok {
+		m.messages[msg.ID] = msg
+	}
+	return nil
+}
+
+// DeleteMessage removes a message of a session.
+func (s *MemorySessionStore) DeleteMessage(clientid string, id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.sessions[clientid]; ok {
+		delete(m.messages, id)
+	}
+	return nil
+}
+
+// Messages returns the messages of a session, ordered by id.
+func (s *MemorySessionStore) Messages(clientid string) ([]StoredMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.sessions[clientid]
+	if !ok {
+		return nil, nil
+	}
+	return m.messageList(), nil
+}
+
+// A FileStore is a Store that keeps everything in a directory: sessions
+// in a WAL, and retained messages in a DiskRetainStore, in the file
+// "retained.log".
+type FileStore struct {
+	*WAL
+	*DiskRetainStore
+}
+
+// OpenFileStore opens the FileStore in dir, creating the directory if it
+// does not exist.
+func OpenFileStore(dir string, opts WALOptions) (*FileStore, error) {
+	w, err := OpenWAL(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	r, err := OpenDiskRetainStore(filepath.Join(dir, "retained.log"))
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return &FileStore{WAL: w, DiskRetainStore: r}, nil
+}
+
+// Close syncs the files of the store to disk and closes them.
+func (s *FileStore) Close() error {
+	err := s.WAL.Close()
+	if rerr := s.DiskRetainStore.Close(); err == nil {
+		err = rerr
+	}
+	return err
+}
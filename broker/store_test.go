@@ -0,0 +1,24 @@
+package broker_test
+
+import (
+	"testing"
+
+	"github.com/zwczou/mqtt/broker"
+	"github.com/zwczou/mqtt/broker/storetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, dir string) broker.Store {
+		return broker.NewMemoryStore()
+	}, false)
+}
+
+func TestFileStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, dir string) broker.Store {
+		s, err := broker.OpenFileStore(dir, broker.WALOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}, true)
+}
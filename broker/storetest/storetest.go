@@ -0,0 +1,427 @@
+// Package storetest checks that implementations of broker.Store behave as
+// the interface says. A store's own tests call Run:
+//
+//	func TestStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T, dir string) broker.Store {
+//			s, err := OpenMyStore(dir)
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return s
+//		}, true)
+//	}
+package storetest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zwczou/mqtt/broker"
+	"github.com/zwczou/mqtt/packets"
+)
+
+// An Opener opens a Store kept in dir, which a Store kept in RAM can
+// ignore.
+type Opener func(t *testing.T, dir string) broker.Store
+
+// Run checks a Store implementation. Each check opens a Store in a new
+// directory. When durable is true, the checks also close the Store, if it
+// is an io.Closer, and open it again in the same directory, expecting to
+// find what it held.
+func Run(t *testing.T, open Opener, durable bool) {
+	checks := []struct {
+		name string
+		f    func(*testing.T, *harness)
+	}{
+		{"Sessions", testSessions},
+		{"Subscriptions", testSubscriptions},
+		{"Messages", testMessages},
+		{"Retained", testRetained},
+		{"Concurrent", testConcurrent},
+	}
+	for _, c := range checks {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			h := &harness{t: t, open: open, dir: t.TempDir(), durable: durable}
+			h.s = open(t, h.dir)
+			t.Cleanup(h.close)
+			c.f(t, h)
+		})
+	}
+}
+
+// A harness holds the Store under test.
+type harness struct {
+	t       *testing.T
+	open    Opener
+	dir     string
+	durable bool
+	s       broker.Store
+}
+
+func (h *harness) close() {
+	if c, ok := h.s.(io.Closer); ok && h.s != nil {
+		if err := c.Close(); err != nil {
+			h.t.Errorf("Close: %v", err)
+		}
+	}
+	h.s = nil
+}
+
+// Close and open the Store again, if it is durable, then run check on
+// it. Without durability, check runs on the Store as it is.
+func (h *harness) reopen(check func()) {
+	check()
+	if !h.durable {
+		return
+	}
+	h.close()
+	h.s = h.open(h.t, h.dir)
+	check()
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sessions(t *testing.T, s broker.Store) map[string]uint32 {
+	t.Helper()
+	m := make(map[string]uint32)
+	must(t, s.Sessions(func(ss broker.StoredSession) bool {
+		m[ss.ClientID] = ss.Expiry
+		return true
+	}))
+	return m
+}
+
+func testSessions(t *testing.T, h *harness) {
+	must(t, h.s.PutSession(broker.StoredSession{ClientID: "a", Expiry: 60}))
+	must(t, h.s.PutSession(broker.StoredSession{ClientID: "b", Expiry: 0xFFFFFFFF}))
+	must(t, h.s.PutSession(broker.StoredSession{ClientID: "c", Expiry: 1}))
+	must(t, h.s.PutSubscription("a", broker.StoredSubscription{Filter: "x/#", QoS: 1}))
+	must(t, h.s.PutMessage("a", broker.StoredMessage{ID: 1, Message: publish("x/1", "one")}))
+
+	// Changing the expiry keeps what the session holds.
+	must(t, h.s.PutSession(broker.StoredSession{ClientID: "a", Expiry: 120}))
+	must(t, h.s.DeleteSession("c"))
+	must(t, h.s.DeleteSession("unknown"))
+
+	h.reopen(func() {
+		got := sessions(t, h.s)
+		want := map[string]uint32{"a": 120, "b": 0xFFFFFFFF}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("sessions = %v, want %v", got, want)
+		}
+		subs, err := h.s.Subscriptions("a")
+		must(t, err)
+		if len(subs) != 1 {
+			t.Fatalf("subscriptions of a = %v, want 1", subs)
+		}
+		msgs, err := h.s.Messages("a")
+		must(t, err)
+		if len(msgs) != 1 {
+			t.Fatalf("messages of a = %v, want 1", msgs)
+		}
+	})
+
+	// Iteration stops when asked to.
+	n := 0
+	must(t, h.s.Sessions(func(broker.StoredSession) bool {
+		n++
+		return false
+	}))
+	if n != 1 {
+		t.Errorf("Sessions went on after false: %d calls", n)
+	}
+
+	// Deleting a session deletes what it holds, and a new session of the
+	// same client id starts empty.
+	must(t, h.s.DeleteSession("a"))
+	must(t, h.s.PutSession(broker.StoredSession{ClientID: "a", Expiry: 60}))
+	h.reopen(func() {
+		subs, err := h.s.Subscriptions("a")
+		must(t, err)
+		msgs, err := h.s.Messages("a")
+		must(t, err)
+		if len(subs) != 0 || len(msgs) != 0 {
+			t.Fatalf("new session holds %v and %v", subs, msgs)
+		}
+	})
+}
+
+func testSubscriptions(t *testing.T, h *harness) {
+	must(t, h.s.PutSession(broker.StoredSession{ClientID: "a", Expiry: 60}))
+	want := map[string]broker.StoredSubscription{
+		"x/#":          {Filter: "x/#", QoS: 2, Identifier: 268435455},
+		"y/+/z":        {Filter: "y/+/z", QoS: 0, Options: packets.SubscriptionOptions{NoLocal: true, RetainAsPublished: true, RetainHandling: 2}},
+		"$share/g/s/t": {Filter: "$share/g/s/t", QoS: 1, Options: packets.SubscriptionOptions{RetainHandling: 1}},
+	}
+	for _, sub := range want {
+		must(t, h.s.PutSubscription("a", sub))
+	}
+	// Replace, delete, and ignore what belongs to no session.
+	must(t, h.s.PutSubscription("a", broker.StoredSubscription{Filter: "gone", QoS: 1}))
+	must(t, h.s.DeleteSubscription("a", "gone"))
+	must(t, h.s.DeleteSubscription("a", "never"))
+	must(t, h.s.PutSubscription("a", broker.StoredSubscription{Filter: "x/#", QoS: 1}))
+	want["x/#"] = broker.StoredSubscription{Filter: "x/#", QoS: 1}
+	must(t, h.s.PutSubscription("nobody", broker.StoredSubscription{Filter: "x", QoS: 1}))
+
+	h.reopen(func() {
+		subs, err := h.s.Subscriptions("a")
+		must(t, err)
+		got := make(map[string]broker.StoredSubscription)
+		for _, sub := range subs {
+			got[sub.Filter] = sub
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("subscriptions = %v, want %v", got, want)
+		}
+		subs, err = h.s.Subscriptions("nobody")
+		must(t, err)
+		if len(subs) != 0 || len(sessions(t, h.s)) != 1 {
+			t.Fatalf("subscription without a session kept: %v", subs)
+		}
+	})
+}
+
+func publish(topic, payload string) *packets.PublishPacket {
+	m := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	m.Qos = 1
+	m.TopicName = topic
+	m.Payload = []byte(payload)
+	return m
+}
+
+// Compare the parts of messages that a Store must keep.
+func sameMessage(a, b *packets.PublishPacket) error {
+	switch {
+	case a.TopicName != b.TopicName:
+		return fmt.Errorf("topic %q, want %q", a.TopicName, b.TopicName)
+	case !bytes.Equal(a.Payload, b.Payload):
+		return fmt.Errorf("payload %q, want %q", a.Payload, b.Payload)
+	case a.Qos != b.Qos || a.Retain != b.Retain:
+		return fmt.Errorf("qos %d retain %v, want %d %v", a.Qos, a.Retain, b.Qos, b.Retain)
+	}
+	pa, pb := a.Properties, b.Properties
+	if pb == nil {
+		return nil
+	}
+	if pa == nil {
+		return fmt.Errorf("properties lost")
+	}
+	if pa.ContentType != pb.ContentType || !bytes.Equal(pa.CorrelationData, pb.CorrelationData) ||
+		pa.ResponseTopic != pb.ResponseTopic ||
+		!reflect.DeepEqual(pa.MessageExpiry, pb.MessageExpiry) ||
+		!reflect.DeepEqual(pa.PayloadFormat, pb.PayloadFormat) ||
+		len(pa.User) != len(pb.User) ||
+		fmt.Sprint(pa.SubscriptionIdentifier) != fmt.Sprint(pb.SubscriptionIdentifier) {
+		return fmt.Errorf("properties %v, want %v", pa, pb)
+	}
+	for i := range pb.User {
+		if pa.User[i] != pb.User[i] {
+			return fmt.Errorf("user properties %v, want %v", pa.User, pb.User)
+		}
+	}
+	return nil
+}
+
+func testMessages(t *testing.T, h *harness) {
+	must(t, h.s.PutSession(broker.StoredSession{ClientID: "a", Expiry: 60}))
+	rich := publish("x/rich", "payload")
+	rich.Qos = 2
+	rich.Retain = true
+	rich.Properties = &packets.Properties{
+		PayloadFormat:          packets.Byte(1),
+		MessageExpiry:          packets.Uint32(30),
+		ContentType:            "text/plain",
+		ResponseTopic:          "reply/to",
+		CorrelationData:        []byte{1, 2, 3},
+		SubscriptionIdentifier: []int{7, 300},
+		User:                   []packets.UserProperty{{Key: "k", Value: "v"}, {Key: "k", Value: "w"}},
+	}
+	expires := time.Unix(2000000000, 123456789)
+	want := []broker.StoredMessage{
+		{ID: 2, Message: rich, Expires: expires},
+		{ID: 3, Message: publish("x/3", "three"), PacketID: 7},
+		{ID: 10, Message: publish("x/10", ""), PacketID: 9, Pubrel: true},
+	}
+	// Put out of order, with a message deleted and states changed.
+	must(t, h.s.PutMessage("a", want[2]))
+	must(t, h.s.PutMessage("a", broker.StoredMessage{ID: 5, Message: publish("x/5", "five")}))
+	must(t, h.s.PutMessage("a", want[0]))
+	must(t, h.s.PutMessage("a", broker.StoredMessage{ID: 3, Message: want[1].Message}))
+	must(t, h.s.PutMessage("a", want[1]))
+	must(t, h.s.DeleteMessage("a", 5))
+	must(t, h.s.DeleteMessage("a", 99))
+	must(t, h.s.PutMessage("nobody", want[1]))
+
+	h.reopen(func() {
+		got, err := h.s.Messages("a")
+		must(t, err)
+		if len(got) != len(want) {
+			t.Fatalf("got %d messages, want %d", len(got), len(want))
+		}
+		for i, msg := range got {
+			w := want[i]
+			if msg.ID != w.ID || msg.PacketID != w.PacketID || msg.Pubrel != w.Pubrel || !msg.Expires.Equal(w.Expires) {
+				t.Fatalf("message %d = %+v, want %+v", i, msg, w)
+			}
+			if err := sameMessage(msg.Message, w.Message); err != nil {
+				t.Fatalf("message %d: %v", w.ID, err)
+			}
+		}
+		if msgs, err := h.s.Messages("nobody"); err != nil || len(msgs) != 0 {
+			t.Fatalf("message without a session kept: %v %v", msgs, err)
+		}
+	})
+
+	// A change of state only.
+	want[0].PacketID = 11
+	want[0].Pubrel = true
+	must(t, h.s.PutMessage("a", want[0]))
+	h.reopen(func() {
+		got, err := h.s.Messages("a")
+		must(t, err)
+		if len(got) != 3 || got[0].PacketID != 11 || !got[0].Pubrel || !got[0].Expires.Equal(expires) {
+			t.Fatalf("state not changed: %+v", got)
+		}
+		if err := sameMessage(got[0].Message, rich); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func retained(topic, payload string) broker.Retained {
+	m := publish(topic, payload)
+	m.Retain = true
+	return broker.Retained{Message: m}
+}
+
+func topics(list []broker.Retained) []string {
+	var names []string
+	for _, r := range list {
+		names = append(names, r.Message.TopicName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func testRetained(t *testing.T, h *harness) {
+	withExpiry := retained("a/b", "ab")
+	withExpiry.Expires = time.Unix(2000000000, 5)
+	withExpiry.Message.Properties = &packets.Properties{ContentType: "text/plain"}
+	for _, r := range []broker.Retained{
+		retained("a", "old"), retained("a", "a"), withExpiry, retained("a/b/c", "abc"),
+		retained("b", "b"), retained("$SYS/x", "sys"), retained("gone", "gone"),
+	} {
+		must(t, h.s.Put(r))
+	}
+	must(t, h.s.Delete("gone"))
+	must(t, h.s.Delete("never"))
+
+	h.reopen(func() {
+		for filter, want := range map[string]string{
+			"a":      "[a]",
+			"a/b":    "[a/b]",
+			"none":   "[]",
+			"#":      "[a a/b a/b/c b]",
+			"a/#":    "[a a/b a/b/c]",
+			"a/+":    "[a/b]",
+			"+/+/c":  "[a/b/c]",
+			"$SYS/#": "[$SYS/x]",
+		} {
+			list, err := h.s.Match(filter)
+			must(t, err)
+			if got := fmt.Sprint(topics(list)); got != want {
+				t.Errorf("Match(%q) = %s, want %s", filter, got, want)
+			}
+		}
+		list, err := h.s.Match("a")
+		must(t, err)
+		if len(list) != 1 || string(list[0].Message.Payload) != "a" || !list[0].Message.Retain {
+			t.Fatalf("Match(a) = %v, want the last put", list)
+		}
+		list, err = h.s.Match("a/b")
+		must(t, err)
+		if len(list) != 1 || !list[0].Expires.Equal(withExpiry.Expires) {
+			t.Fatalf("Match(a/b) = %v, want expiry %v", list, withExpiry.Expires)
+		}
+		if err := sameMessage(list[0].Message, withExpiry.Message); err != nil {
+			t.Fatal(err)
+		}
+
+		var all []broker.Retained
+		must(t, h.s.Iterate(func(r broker.Retained) bool {
+			all = append(all, r)
+			return true
+		}))
+		if got := fmt.Sprint(topics(all)); got != "[$SYS/x a a/b a/b/c b]" {
+			t.Fatalf("Iterate = %s", got)
+		}
+	})
+
+	n := 0
+	must(t, h.s.Iterate(func(broker.Retained) bool {
+		n++
+		return false
+	}))
+	if n != 1 {
+		t.Errorf("Iterate went on after false: %d calls", n)
+	}
+}
+
+func testConcurrent(t *testing.T, h *harness) {
+	const clients, messages = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clientid := fmt.Sprintf("c%d", i)
+			if err := h.s.PutSession(broker.StoredSession{ClientID: clientid, Expiry: 60}); err != nil {
+				t.Error(err)
+				return
+			}
+			for j := 1; j <= messages; j++ {
+				topic := fmt.Sprintf("%s/%d", clientid, j)
+				if err := h.s.PutMessage(clientid, broker.StoredMessage{ID: uint64(j), Message: publish(topic, "m")}); err != nil {
+					t.Error(err)
+				}
+				if err := h.s.Put(retained(topic, "r")); err != nil {
+					t.Error(err)
+				}
+				if j%2 == 0 {
+					if err := h.s.DeleteMessage(clientid, uint64(j)); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	h.reopen(func() {
+		for i := 0; i < clients; i++ {
+			msgs, err := h.s.Messages(fmt.Sprintf("c%d", i))
+			must(t, err)
+			if len(msgs) != messages/2 {
+				t.Fatalf("client %d has %d messages, want %d", i, len(msgs), messages/2)
+			}
+		}
+		list, err := h.s.Match("#")
+		must(t, err)
+		if len(list) != clients*messages {
+			t.Fatalf("%d retained messages, want %d", len(list), clients*messages)
+		}
+	})
+}
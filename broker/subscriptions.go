@@ -2,39 +2,91 @@ package broker
 
 import (
 	"log"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/zwczou/mqtt/packets"
 )
 
-// A retain holds information necessary to correctly manage retained
-// messages.
-//
-// This needs to hold copies of the proto.Publish, not pointers to
-// it, or else we can send out one with the wrong retain flag.
-type retain struct {
-	m    *packets.PublishPacket
-	wild wild
+// A subscription ties a session to a topic filter, at the QoS granted
+// in the SUBACK and with the MQTT 5 subscription options.
+type subscription struct {
+	s    *session
+	qos  byte
+	opts packets.SubscriptionOptions
+	ids  []int // Subscription Identifier, if any; several once merged
+}
+
+// Merge the subscriptions of each session, so that a client whose topic
+// filters overlap gets a single copy of a message: at the highest QoS
+// granted, with the identifiers of all the matching subscriptions, and
+// with the retain flag if any of them keeps it as published.
+// Subscriptions with No Local are left out for the publisher's session.
+func merge(subs []subscription, publisher *session) []subscription {
+	merged := make([]subscription, 0, len(subs))
+	index := make(map[*session]int, len(subs))
+	for _, sub := range subs {
+		if sub.opts.NoLocal && sub.s == publisher {
+			continue
+		}
+		i, ok := index[sub.s]
+		if !ok {
+			index[sub.s] = len(merged)
+			merged = append(merged, subscription{s: sub.s, qos: sub.qos, opts: sub.opts, ids: sub.ids})
+			continue
+		}
+		m := &merged[i]
+		if sub.qos > m.qos {
+			m.qos = sub.qos
+		}
+		m.opts.RetainAsPublished = m.opts.RetainAsPublished || sub.opts.RetainAsPublished
+		// The ids belong to the trie: append to a copy.
+		m.ids = append(m.ids[:len(m.ids):len(m.ids)], sub.ids...)
+	}
+	return merged
 }
 
 // A post is a unit of work for the subscription processing workers.
 type post struct {
-	c *incomingConn
-	m *packets.PublishPacket
+	c       *incomingConn
+	m       *packets.PublishPacket
+	retain  *packets.PublishPacket // m with the Retain flag, if it had it
+	expires time.Time              // zero if the message never expires
+}
+
+// The message to deliver through a subscription: the one with the Retain
+// flag if the subscription keeps it as published.
+func (p post) message(sub subscription) *packets.PublishPacket {
+	if sub.opts.RetainAsPublished && p.retain != nil {
+		return p.retain
+	}
+	return p.m
+}
+
+// The time at which a message received at now expires, according to its
+// MQTT 5 Message Expiry Interval, or the zero time if it has none.
+func expiry(m *packets.PublishPacket, now time.Time) time.Time {
+	if m.Properties == nil || m.Properties.MessageExpiry == nil {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(*m.Properties.MessageExpiry) * time.Second)
+}
+
+// Report whether the expiry time t has passed. The zero time never does.
+func expired(t time.Time, now time.Time) bool {
+	return !t.IsZero() && !now.Before(t)
 }
 
 type subscriptions struct {
 	sync.WaitGroup
+	svr *Server
 
 	workers int
 	posts   chan (post)
 
-	mu        sync.Mutex // guards access to fields below
-	subs      map[string][]*incomingConn
-	wildcards []wild
-	retain    map[string]retain
-	stats     *stats
+	tree *trie // has a lock of its own
+
+	stats *stats
 
 	stop chan struct{}
 }
@@ -43,10 +95,10 @@ type subscriptions struct {
 // workers are taking from.
 const postQueue = 200
 
-func newSubscriptions(workers int) *subscriptions {
+func newSubscriptions(svr *Server, workers int) *subscriptions {
 	s := &subscriptions{
-		subs:    make(map[string][]*incomingConn),
-		retain:  make(map[string]retain),
+		svr:     svr,
+		tree:    newTrie(),
 		posts:   make(chan post, postQueue),
 		stop:    make(chan struct{}),
 		workers: workers,
@@ -58,104 +110,88 @@ func newSubscriptions(workers int) *subscriptions {
 	return s
 }
 
-func (s *subscriptions) sendRetain(topic string, c *incomingConn) {
-	s.mu.Lock()
-	var tlist []string
-	if isWildcard(topic) {
-		parts := strings.Split(topic, "/")
-		for k, _ := range s.retain {
-			if newWild(k, c).matches(parts) {
-				tlist = append(tlist, k)
-			}
+// Send the retained messages matching the topic filter of a new
+// subscription, as its Retain Handling option says: always, only if the
+// subscription did not exist yet, or never.
+func (s *subscriptions) sendRetain(topic string, sub subscription, existed bool) {
+	switch sub.opts.RetainHandling {
+	case 1:
+		if existed {
+			return
 		}
-	} else {
-		tlist = []string{topic}
+	case 2:
+		return
 	}
-	for _, t := range tlist {
-		if r, ok := s.retain[t]; ok {
-			c.submit(r.m)
+
+	list, err := s.svr.Store.Match(topic)
+	if err != nil {
+		log.Printf("ERROR: failed to look up retained messages for %s - %s", topic, err)
+		return
+	}
+	now := time.Now()
+	for _, r := range list {
+		if expired(r.Expires, now) {
+			s.deleteRetained(r.Message.TopicName)
+			continue
 		}
+		sub.s.deliver(r.Message, sub.qos, sub.ids, r.Expires)
 	}
-	s.mu.Unlock()
 }
 
-func (s *subscriptions) add(topic string, c *incomingConn) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if isWildcard(topic) {
-		w := newWild(topic, c)
-		if w.valid() {
-			s.wildcards = append(s.wildcards, w)
+// Drop the retained messages whose expiry time has passed. It returns the
+// number of retained messages left.
+func (s *subscriptions) expireRetained() int {
+	now := time.Now()
+	var topics []string
+	n := 0
+	s.svr.Store.Iterate(func(r Retained) bool {
+		if expired(r.Expires, now) {
+			topics = append(topics, r.Message.TopicName)
+		} else {
+			n++
 		}
-	} else {
-		s.subs[topic] = append(s.subs[topic], c)
+		return true
+	})
+	for _, t := range topics {
+		s.deleteRetained(t)
 	}
+	return n
 }
 
-// Find all connections that are subscribed to this topic.
-func (s *subscriptions) subscribers(topic string) []*incomingConn {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	// non-wildcard subscribers
-	res := s.subs[topic]
-
-	// process wildcards
-	parts := strings.Split(topic, "/")
-	for _, w := range s.wildcards {
-		if w.matches(parts) {
-			res = append(res, w.c)
-		}
+func (s *subscriptions) deleteRetained(topic string) {
+	if err := s.svr.Store.Delete(topic); err != nil {
+		log.Printf("ERROR: failed to delete retained message %s - %s", topic, err)
 	}
+}
 
-	return res
+// Subscribe a session to a topic filter, or update the granted QoS of an
+// existing subscription to the same filter.
+func (s *subscriptions) add(topic string, sub subscription) {
+	s.tree.add(topic, sub)
 }
 
-// Remove all subscriptions that refer to a connection.
-func (s *subscriptions) unsubAll(c *incomingConn) {
-	s.mu.Lock()
-	for _, v := range s.subs {
-		for i := range v {
-			if v[i] == c {
-				v[i] = nil
-			}
-		}
-	}
+// Find all subscriptions that match this topic.
+func (s *subscriptions) subscribers(topic string) *matches {
+	return s.tree.match(topic)
+}
 
-	// remove any associated entries in the wildcard list
-	var wildNew []wild
-	for i := 0; i < len(s.wildcards); i++ {
-		if s.wildcards[i].c != c {
-			wildNew = append(wildNew, s.wildcards[i])
-		}
+// Remove all subscriptions of a session.
+func (s *subscriptions) unsubAll(sess *session) {
+	sess.mu.Lock()
+	topics := make([]string, 0, len(sess.subs))
+	for topic := range sess.subs {
+		topics = append(topics, topic)
 	}
-	s.wildcards = wildNew
+	sess.mu.Unlock()
 
-	s.mu.Unlock()
+	for _, topic := range topics {
+		s.tree.remove(topic, sess)
+	}
 }
 
-// Remove the subscription to topic for a given connection.
-func (s *subscriptions) unsub(topic string, c *incomingConn) {
-	s.mu.Lock()
-	if subs, ok := s.subs[topic]; ok {
-		nils := 0
-
-		// Search the list, removing references to our connection.
-		// At the same time, count the nils to see if this list is now empty.
-		for i := 0; i < len(subs); i++ {
-			if subs[i] == c {
-				subs[i] = nil
-			}
-			if subs[i] == nil {
-				nils++
-			}
-		}
-
-		if nils == len(subs) {
-			delete(s.subs, topic)
-		}
-	}
-	s.mu.Unlock()
+// Remove the subscription to topic for a given session.
+func (s *subscriptions) unsub(topic string, sess *session) {
+	s.tree.remove(topic, sess)
 }
 
 // The subscription processing worker.
@@ -164,42 +200,55 @@ func (s *subscriptions) run(id int) {
 	for {
 		select {
 		case post := <-s.posts:
+			// A message may expire while waiting for a worker.
+			if expired(post.expires, time.Now()) {
+				s.svr.stats.messageDrop()
+				break
+			}
+
 			// Remember the original retain setting, but send out immediate
 			// copies without retain: "When a server sends a PUBLISH to a client
 			// as a result of a subscription that already existed when the
 			// original PUBLISH arrived, the Retain flag should not be set,
 			// regardless of the Retain flag of the original PUBLISH.
+			// MQTT 5 subscriptions with Retain As Published get a copy with
+			// the flag kept.
 			isRetain := post.m.Retain
+			if isRetain {
+				post.retain = copyPublish(post.m)
+			}
 			post.m.Retain = false
 
 			// Handle "retain with payload size zero = delete retain".
 			// Once the delete is done, return instead of continuing.
 			if isRetain && len(post.m.Payload) == 0 {
-				s.mu.Lock()
-				delete(s.retain, post.m.TopicName)
-				s.mu.Unlock()
+				s.deleteRetained(post.m.TopicName)
 				break
 			}
 
-			// Find all the connections that should be notified of this message.
-			conns := s.subscribers(post.m.TopicName)
+			// Find all the sessions that should be notified of this message.
+			matches := s.subscribers(post.m.TopicName)
 
 			// Queue the outgoing messages
-			for _, c := range conns {
-				if c != nil {
-					c.submit(post.m)
-				}
+			var publisher *session
+			if post.c != nil {
+				publisher = post.c.sess
+			}
+			for _, sub := range merge(matches.subs, publisher) {
+				sub.s.deliver(post.message(sub), sub.qos, sub.ids, post.expires)
+			}
+			for _, sh := range matches.shared {
+				s.deliverShared(sh, post)
 			}
 
 			if isRetain {
-				s.mu.Lock()
-				// Save a copy of it, and set that copy's Retain to true, so that
-				// when we send it out later we notify new subscribers that this
-				// is an old message.
-				msg := post.m
-				msg.Retain = true
-				s.retain[post.m.TopicName] = retain{m: msg}
-				s.mu.Unlock()
+				// Save the copy that has Retain set, so that when we send it
+				// out later we notify new subscribers that this is an old
+				// message.
+				err := s.svr.Store.Put(Retained{Message: post.retain, Expires: post.expires})
+				if err != nil {
+					log.Printf("ERROR: failed to store retained message %s - %s", post.m.TopicName, err)
+				}
 			}
 		case <-s.stop:
 			goto exit
@@ -212,5 +261,5 @@ exit:
 }
 
 func (s *subscriptions) submit(c *incomingConn, m *packets.PublishPacket) {
-	s.posts <- post{c: c, m: m}
+	s.posts <- post{c: c, m: m, expires: expiry(m, time.Now())}
 }
@@ -0,0 +1,178 @@
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+// TLSOptions configure a TLSListener.
+type TLSOptions struct {
+	CertFile string // PEM certificate chain of the server
+	KeyFile  string // PEM private key of the server
+
+	// PEM certificates of the CAs that client certificates are verified
+	// against. When set, clients may present a certificate (mutual TLS);
+	// one that does not verify fails the handshake.
+	ClientCAFile string
+
+	// When true, clients must present a certificate that verifies against
+	// ClientCAFile.
+	RequireClientCert bool
+
+	// The TLS 1.2 cipher suites offered, in order of preference; nil for
+	// the Go defaults. The TLS 1.3 suites cannot be configured.
+	CipherSuites []uint16
+
+	// The lowest TLS version accepted. Defaults to tls.VersionTLS12.
+	MinVersion uint16
+}
+
+// A TLSListener is a TLS listener for a Server, usually on port 8883. Its
+// certificates are read from files, and reread by Reload; handshakes
+// after that use the new ones, while existing connections are kept.
+type TLSListener struct {
+	net.Listener
+	opts   TLSOptions
+	config atomic.Value // *tls.Config
+}
+
+// ListenTLS listens on a TCP address for TLS connections.
+func ListenTLS(addr string, opts TLSOptions) (*TLSListener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tl, err := NewTLSListener(l, opts)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return tl, nil
+}
+
+// NewTLSListener makes TLS connections of those accepted by a listener.
+func NewTLSListener(inner net.Listener, opts TLSOptions) (*TLSListener, error) {
+	if opts.RequireClientCert && opts.ClientCAFile == "" {
+		return nil, errors.New("client certificates required without a CA to verify them")
+	}
+	l := &TLSListener{opts: opts}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	l.Listener = tls.NewListener(inner, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return l.config.Load().(*tls.Config), nil
+		},
+	})
+	return l, nil
+}
+
+// Reload rereads the certificate, key and client CA files. If any of them
+// is bad, the ones loaded before are kept.
+func (l *TLSListener) Reload() error {
+	cert, err := tls.LoadX509KeyPair(l.opts.CertFile, l.opts.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		CipherSuites:             l.opts.CipherSuites,
+		PreferServerCipherSuites: true,
+		MinVersion:               l.opts.MinVersion,
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if l.opts.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(l.opts.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates", l.opts.ClientCAFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if l.opts.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	l.config.Store(config)
+	return nil
+}
+
+// CertIdentity is what the Server takes a verified client certificate to
+// name.
+type CertIdentity int
+
+const (
+	// The certificate names nobody: clients authenticate as on any other
+	// connection.
+	CertIdentityNone CertIdentity = iota
+
+	// The certificate names the user, replacing the user name of the
+	// CONNECT.
+	CertIdentityUsername
+
+	// The certificate names the client, replacing the client id of the
+	// CONNECT. Its user name and password, which nobody checks, are
+	// dropped.
+	CertIdentityClientID
+)
+
+// CertName returns the name a certificate gives its subject: the Common
+// Name, or if it has none, its first DNS name, email address or URI
+// Subject Alternative Name.
+func CertName(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// Take the identity of a client from the certificate it presented, as the
+// Server's CertIdentity says, if it did present one that verified. Such a
+// client has proven who it is, and is not passed to the Authenticator;
+// the Authorizer sees the name of the certificate. It returns whether the
+// CONNECT was changed, and packets.Accepted or the code to refuse it
+// with.
+func (c *incomingConn) certIdentity(m *packets.ConnectPacket) (bool, byte) {
+	if c.svr.CertIdentity == CertIdentityNone {
+		return false, packets.Accepted
+	}
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return false, packets.Accepted
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return false, packets.Accepted
+	}
+	name := CertName(state.VerifiedChains[0][0])
+	if name == "" {
+		return false, packets.ErrRefusedNotAuthorised
+	}
+	switch c.svr.CertIdentity {
+	case CertIdentityUsername:
+		m.Username, m.UsernameFlag = name, true
+	case CertIdentityClientID:
+		m.ClientIdentifier = name
+		m.Username, m.UsernameFlag = "", false
+		m.Password, m.PasswordFlag = nil, false
+	}
+	return true, packets.Accepted
+}
@@ -0,0 +1,250 @@
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+// A certKey is a certificate made for a test, with its key.
+type certKey struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCertKey makes a certificate from a template, signed by parent, or
+// self-signed if parent is nil.
+func newCertKey(t *testing.T, tmpl *x509.Certificate, parent *certKey) *certKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	signer, signKey := tmpl, key
+	if parent != nil {
+		signer, signKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &certKey{cert: cert, key: key}
+}
+
+func newCA(t *testing.T, name string) *certKey {
+	return newCertKey(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newClientCert(t *testing.T, name string, ca *certKey) *certKey {
+	return newCertKey(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+}
+
+func newServerCert(t *testing.T, name string, ca *certKey) *certKey {
+	return newCertKey(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+}
+
+// writeFiles writes the certificate and key in PEM to the given files.
+func (c *certKey) writeFiles(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *certKey) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// connectTLS connects a client over TLS, returning the connection state
+// with the CONNACK, nil if there was none.
+func connectTLS(t *testing.T, addr string, config *tls.Config, m *packets.ConnectPacket) (*testClient, tls.ConnectionState, *packets.ConnackPacket) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, tls.ConnectionState{}, nil
+	}
+	c, connack := connectConn(t, conn, m)
+	return c, conn.ConnectionState(), connack
+}
+
+// A failingAuth is an Authenticator whose Reload fails.
+type failingAuth struct{}
+
+func (failingAuth) Authenticate(addr net.Addr, m *packets.ConnectPacket) byte {
+	return packets.ErrRefusedNotAuthorised
+}
+
+func (failingAuth) Reload() error {
+	return errors.New("auth reload failed")
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	caFile := filepath.Join(dir, "ca.crt")
+	ca := newCA(t, "ca")
+	newServerCert(t, "server1", ca).writeFiles(t, certFile, keyFile)
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tl, err := ListenTLS("127.0.0.1:0", TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := make(chan string, 10)
+	s := newTestServer(t, func(s *Server) {
+		s.AddListener(tl)
+		s.CertIdentity = CertIdentityUsername
+		s.Auth = failingAuth{}
+		s.Authz = AuthorizerFunc(func(m *packets.ConnectPacket, topic string, access Access) bool {
+			users <- m.Username
+			return true
+		})
+	})
+	addr := tl.Addr().String()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// A verified client certificate names the user, who skips the
+	// Authenticator, and is who the Authorizer sees.
+	alice := newClientCert(t, "alice", ca).tlsCert()
+	c, state, connack := connectTLS(t, addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{alice}}, newConnect("a", true))
+	if connack == nil || connack.ReturnCode != packets.Accepted {
+		t.Fatalf("client with a certificate: got %v", connack)
+	}
+	if got := state.PeerCertificates[0].Subject.CommonName; got != "server1" {
+		t.Fatalf("server certificate %s, want server1", got)
+	}
+	c.subscribe(1, "t", 0)
+	if got := <-users; got != "alice" {
+		t.Fatalf("Authorizer saw %q, want alice", got)
+	}
+
+	// Without a certificate, the Authenticator decides.
+	m := newConnect("b", true)
+	m.Username, m.UsernameFlag = "alice", true
+	if _, _, connack := connectTLS(t, addr, &tls.Config{RootCAs: roots}, m); connack != nil && connack.ReturnCode == packets.Accepted {
+		t.Fatal("client without a certificate accepted as alice")
+	}
+	// A certificate from another CA fails the handshake.
+	mallory := newClientCert(t, "alice", newCA(t, "rogue")).tlsCert()
+	config := &tls.Config{RootCAs: roots, GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &mallory, nil
+	}}
+	if _, _, connack := connectTLS(t, addr, config, newConnect("m", true)); connack != nil {
+		t.Fatalf("client with a rogue certificate got %v", connack)
+	}
+
+	// Reload goes on past the failing Authenticator: new handshakes use
+	// the new server certificate, while existing connections are kept.
+	newServerCert(t, "server2", ca).writeFiles(t, certFile, keyFile)
+	if err := s.Reload(); err == nil || !strings.Contains(err.Error(), "auth reload failed") {
+		t.Fatalf("Reload: got %v, want the error of the Authenticator", err)
+	}
+	_, state, connack = connectTLS(t, addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{alice}}, newConnect("a2", true))
+	if connack == nil || state.PeerCertificates[0].Subject.CommonName != "server2" {
+		t.Fatalf("after Reload: got %v from %s, want server2", connack, state.PeerCertificates[0].Subject.CommonName)
+	}
+	c.subscribe(2, "t", 0)
+	if got := <-users; got != "alice" {
+		t.Fatalf("Authorizer saw %q on the kept connection, want alice", got)
+	}
+
+	// Every failure is reported, and a listener failing to reload keeps
+	// its certificate.
+	if err := os.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = s.Reload()
+	if err == nil || !strings.Contains(err.Error(), "auth reload failed") || strings.Count(err.Error(), ";") != 1 {
+		t.Fatalf("Reload: got %v, want the errors of the Authenticator and the listener", err)
+	}
+	_, state, connack = connectTLS(t, addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{alice}}, newConnect("a3", true))
+	if connack == nil || state.PeerCertificates[0].Subject.CommonName != "server2" {
+		t.Fatal("listener lost its certificate after a failed Reload")
+	}
+}
+
+func TestTLSCertClientID(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	caFile := filepath.Join(dir, "ca.crt")
+	ca := newCA(t, "ca")
+	newServerCert(t, "server", ca).writeFiles(t, certFile, keyFile)
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tl, err := ListenTLS("127.0.0.1:0", TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(chan *packets.ConnectPacket, 1)
+	newTestServer(t, func(s *Server) {
+		s.AddListener(tl)
+		s.CertIdentity = CertIdentityClientID
+		s.Auth = failingAuth{}
+		s.Authz = AuthorizerFunc(func(m *packets.ConnectPacket, topic string, access Access) bool {
+			seen <- m
+			return true
+		})
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// The certificate names the client; the user name it claims, with a
+	// password nobody checks, is not taken.
+	device := newClientCert(t, "device1", ca).tlsCert()
+	m := newConnect("other", true)
+	m.Username, m.UsernameFlag = "admin", true
+	m.Password, m.PasswordFlag = []byte("wrong"), true
+	c, _, connack := connectTLS(t, tl.Addr().String(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{device}}, m)
+	if connack == nil || connack.ReturnCode != packets.Accepted {
+		t.Fatalf("client with a certificate: got %v", connack)
+	}
+	c.subscribe(1, "t", 0)
+	got := <-seen
+	if got.ClientIdentifier != "device1" || got.UsernameFlag || got.Username != "" {
+		t.Fatalf("Authorizer saw client %q, user %q, want device1 and no user", got.ClientIdentifier, got.Username)
+	}
+}
@@ -0,0 +1,265 @@
+package broker
+
+import (
+	"strings"
+	"sync"
+)
+
+// A trie holds subscriptions indexed by the levels of their topic filter.
+// Finding the subscriptions that match a topic walks the levels of the
+// topic, following the exact, "+" and "#" branches, so it takes time
+// proportional to the depth of the topic rather than to the number of
+// subscriptions.
+type trie struct {
+	mu   sync.RWMutex // guards access to the nodes
+	root *node
+}
+
+type node struct {
+	children map[string]*node
+	subs     map[*session]subscription // subscriptions whose filter ends here
+	shared   map[string]*shareGroup    // shared subscriptions, by group name
+}
+
+func newNode() *node {
+	return &node{
+		children: make(map[string]*node),
+		subs:     make(map[*session]subscription),
+		shared:   make(map[string]*shareGroup),
+	}
+}
+
+func (n *node) empty() bool {
+	return len(n.subs) == 0 && len(n.shared) == 0 && len(n.children) == 0
+}
+
+func newTrie() *trie {
+	return &trie{root: newNode()}
+}
+
+// Add a subscription to a topic filter, replacing any subscription of the
+// same session to that filter. Shared subscriptions join their group.
+func (t *trie) add(filter string, sub subscription) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	group, inner, shared := parseShare(filter)
+	if shared {
+		filter = inner
+	}
+
+	n := t.root
+	for _, level := range strings.Split(filter, "/") {
+		child, ok := n.children[level]
+		if !ok {
+			child = newNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+	if !shared {
+		n.subs[sub.s] = sub
+		return
+	}
+	g, ok := n.shared[group]
+	if !ok {
+		g = &shareGroup{}
+		n.shared[group] = g
+	}
+	g.add(sub)
+}
+
+// Remove the subscription of a session to a topic filter, pruning the
+// branches left empty.
+func (t *trie) remove(filter string, sess *session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	group, inner, shared := parseShare(filter)
+	if shared {
+		filter = inner
+	}
+
+	levels := strings.Split(filter, "/")
+	path := make([]*node, 0, len(levels)+1)
+	n := t.root
+	for _, level := range levels {
+		path = append(path, n)
+		n = n.children[level]
+		if n == nil {
+			return
+		}
+	}
+	if !shared {
+		delete(n.subs, sess)
+	} else if g, ok := n.shared[group]; ok {
+		g.remove(sess)
+		if len(g.members) == 0 {
+			delete(n.shared, group)
+		}
+	}
+
+	for i := len(levels) - 1; i >= 0; i-- {
+		if !n.empty() {
+			break
+		}
+		n = path[i]
+		delete(n.children, levels[i])
+	}
+}
+
+// The subscriptions matching a topic.
+type matches struct {
+	subs   []subscription
+	shared []share
+}
+
+// Find the subscriptions whose filter matches a topic. Following the
+// spec, wildcards at the first level do not match topics starting with $.
+func (t *trie) match(topic string) *matches {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	res := &matches{}
+	levels := strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") {
+		if n := t.root.children[levels[0]]; n != nil {
+			n.match(levels[1:], res)
+		}
+		return res
+	}
+	t.root.match(levels, res)
+	return res
+}
+
+func (n *node) match(levels []string, res *matches) {
+	// "#" matches the parent level too: a/# matches a.
+	if c := n.children["#"]; c != nil {
+		c.collect(res)
+	}
+	if len(levels) == 0 {
+		n.collect(res)
+		return
+	}
+	if c := n.children["+"]; c != nil {
+		c.match(levels[1:], res)
+	}
+	if c := n.children[levels[0]]; c != nil {
+		c.match(levels[1:], res)
+	}
+}
+
+func (n *node) collect(res *matches) {
+	if free := cap(res.subs) - len(res.subs); free < len(n.subs) {
+		subs := make([]subscription, len(res.subs), len(res.subs)+len(n.subs))
+		copy(subs, res.subs)
+		res.subs = subs
+	}
+	for _, sub := range n.subs {
+		res.subs = append(res.subs, sub)
+	}
+	for _, g := range n.shared {
+		res.shared = append(res.shared, share{g: g, members: g.members})
+	}
+}
+
+// A retainTrie holds retained messages indexed by the levels of their
+// topic. Finding the messages that match a topic filter walks the levels
+// of the filter, so a filter without "#" only visits the topics that can
+// match it.
+type retainTrie struct {
+	root *retainNode
+}
+
+type retainNode struct {
+	children map[string]*retainNode
+	r        *Retained // the message retained for the topic ending here
+}
+
+func newRetainNode() *retainNode {
+	return &retainNode{children: make(map[string]*retainNode)}
+}
+
+func newRetainTrie() *retainTrie {
+	return &retainTrie{root: newRetainNode()}
+}
+
+// Set the retained message of its topic.
+func (t *retainTrie) put(r Retained) {
+	n := t.root
+	for _, level := range strings.Split(r.Message.TopicName, "/") {
+		child, ok := n.children[level]
+		if !ok {
+			child = newRetainNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+	n.r = &r
+}
+
+// Remove the retained message of a topic, pruning the branches left
+// empty.
+func (t *retainTrie) delete(topic string) {
+	levels := strings.Split(topic, "/")
+	path := make([]*retainNode, 0, len(levels))
+	n := t.root
+	for _, level := range levels {
+		path = append(path, n)
+		n = n.children[level]
+		if n == nil {
+			return
+		}
+	}
+	n.r = nil
+	for i := len(levels) - 1; i >= 0; i-- {
+		if n.r != nil || len(n.children) > 0 {
+			break
+		}
+		n = path[i]
+		delete(n.children, levels[i])
+	}
+}
+
+// Find the retained messages whose topic matches a filter. Following the
+// spec, wildcards at the first level do not match topics starting with $.
+func (t *retainTrie) match(filter string) []Retained {
+	var res []Retained
+	t.root.match(strings.Split(filter, "/"), true, &res)
+	return res
+}
+
+func (n *retainNode) match(levels []string, first bool, res *[]Retained) {
+	if len(levels) == 0 {
+		if n.r != nil {
+			*res = append(*res, *n.r)
+		}
+		return
+	}
+	switch levels[0] {
+	case "#":
+		// "#" matches the parent level too: a/# matches a.
+		n.collect(first, res)
+	case "+":
+		for level, c := range n.children {
+			if !first || !strings.HasPrefix(level, "$") {
+				c.match(levels[1:], false, res)
+			}
+		}
+	default:
+		if c := n.children[levels[0]]; c != nil {
+			c.match(levels[1:], false, res)
+		}
+	}
+}
+
+func (n *retainNode) collect(first bool, res *[]Retained) {
+	if n.r != nil {
+		*res = append(*res, *n.r)
+	}
+	for level, c := range n.children {
+		if !first || !strings.HasPrefix(level, "$") {
+			c.collect(false, res)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package broker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+// wildMatch is the matching the broker did before the trie: each filter
+// compared with the topic, level by level.
+func wildMatch(filter, topic []string) bool {
+	// wildcards at the first level do not match topics starting with $
+	if strings.HasPrefix(topic[0], "$") && (filter[0] == "+" || filter[0] == "#") {
+		return false
+	}
+	for i, level := range topic {
+		if i >= len(filter) {
+			return false
+		}
+		if filter[i] == "#" {
+			return true
+		}
+		if level != filter[i] && filter[i] != "+" {
+			return false
+		}
+	}
+	// a/# matches a
+	if len(filter) == len(topic)+1 && filter[len(topic)] == "#" {
+		return true
+	}
+	return len(filter) == len(topic)
+}
+
+var (
+	testFilters = []string{"a/b", "a/+", "a/#", "#", "+/b", "+/+", "a/b/c", "$SYS/#", "$SYS/+", "+", "a/+/c", "/a", "+/a", "+/#"}
+	testTopics  = []string{"a/b", "a", "a/b/c", "$SYS/x", "$SYS", "/a", "b", "a/x/c", "x/b", "a/"}
+)
+
+func TestTrieMatch(t *testing.T) {
+	tr := newTrie()
+	sessions := make(map[string]*session)
+	for _, f := range testFilters {
+		s := &session{clientid: f}
+		sessions[f] = s
+		tr.add(f, subscription{s: s})
+	}
+	for _, topic := range testTopics {
+		var got, want []string
+		for _, sub := range tr.match(topic).subs {
+			got = append(got, sub.s.clientid)
+		}
+		for _, f := range testFilters {
+			if wildMatch(strings.Split(f, "/"), strings.Split(topic, "/")) {
+				want = append(want, f)
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: got %v, want %v", topic, got, want)
+		}
+	}
+
+	for _, f := range testFilters {
+		tr.remove(f, sessions[f])
+	}
+	if len(tr.root.children) != 0 {
+		t.Errorf("branches left after removing every subscription: %v", tr.root.children)
+	}
+}
+
+func TestRetainTrieMatch(t *testing.T) {
+	tr := newRetainTrie()
+	for _, topic := range testTopics {
+		tr.put(Retained{Message: &packets.PublishPacket{TopicName: topic}})
+	}
+	for _, f := range testFilters {
+		var got, want []string
+		for _, r := range tr.match(f) {
+			got = append(got, r.Message.TopicName)
+		}
+		for _, topic := range testTopics {
+			if wildMatch(strings.Split(f, "/"), strings.Split(topic, "/")) {
+				want = append(want, topic)
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: got %q, want %q", f, got, want)
+		}
+	}
+
+	for _, topic := range testTopics {
+		tr.delete(topic)
+	}
+	if len(tr.root.children) != 0 {
+		t.Errorf("branches left after deleting every message: %v", tr.root.children)
+	}
+}
+
+// Subscribe and unsubscribe while matching; run with -race.
+func TestTrieConcurrent(t *testing.T) {
+	tr := newTrie()
+	const workers, rounds = 8, 500
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			s := &session{clientid: fmt.Sprint(w)}
+			for i := 0; i < rounds; i++ {
+				filter := fmt.Sprintf("devices/%d/+", i%10)
+				tr.add(filter, subscription{s: s})
+				tr.add("$share/g/"+filter, subscription{s: s})
+				tr.remove(filter, s)
+				tr.remove("$share/g/"+filter, s)
+			}
+			tr.add("devices/#", subscription{s: s})
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				tr.match(fmt.Sprintf("devices/%d/cmd", i%10))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(tr.match("devices/1/cmd").subs); n != workers {
+		t.Errorf("%d subscriptions left, want %d", n, workers)
+	}
+	if n := len(tr.root.children["devices"].children); n != 1 {
+		t.Errorf("%d branches left under devices, want 1", n)
+	}
+}
+
+const benchSubscribers = 10000
+
+// The filters of the benchmarks: every subscriber on the same filter, or
+// each on its own, of which one matches.
+var benchFilters = map[string]func(i int) string{
+	"same":     func(i int) string { return "devices/+/cmd" },
+	"distinct": func(i int) string { return fmt.Sprintf("devices/%d/cmd", i) },
+}
+
+func BenchmarkTrieMatch(b *testing.B) {
+	for name, filter := range benchFilters {
+		b.Run(name, func(b *testing.B) {
+			tr := newTrie()
+			for i := 0; i < benchSubscribers; i++ {
+				tr.add(filter(i), subscription{s: &session{}})
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tr.match("devices/42/cmd")
+			}
+		})
+	}
+}
+
+func BenchmarkWildMatch(b *testing.B) {
+	for name, filter := range benchFilters {
+		b.Run(name, func(b *testing.B) {
+			var filters [][]string
+			var subs []subscription
+			for i := 0; i < benchSubscribers; i++ {
+				filters = append(filters, strings.Split(filter(i), "/"))
+				subs = append(subs, subscription{s: &session{}})
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				topic := strings.Split("devices/42/cmd", "/")
+				var res []subscription
+				for j, f := range filters {
+					if wildMatch(f, topic) {
+						res = append(res, subs[j])
+					}
+				}
+			}
+		})
+	}
+}
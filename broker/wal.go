@@ -0,0 +1,728 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zwczou/mqtt/packets"
+)
+
+// An FsyncPolicy says when a WAL syncs what it writes to disk.
+type FsyncPolicy int
+
+const (
+	FsyncInterval FsyncPolicy = iota // every WALOptions.SyncInterval
+	FsyncAlways                      // after every record
+	FsyncNever                       // when the operating system sees fit
+)
+
+// WALOptions configure a WAL. The zero value picks the defaults.
+type WALOptions struct {
+	Fsync        FsyncPolicy
+	SyncInterval time.Duration // Defaults to 1 second.
+	SegmentSize  int64         // Defaults to 64 MB. Growth after which a new segment file is started.
+}
+
+// A WAL is a write-ahead log of sessions: a SessionStore that keeps them
+// in local files, and in RAM. It is the part of a FileStore that keeps
+// sessions, with their subscriptions and messages.
+//
+// The log is a directory of segment files, named after their sequence
+// number in hexadecimal with the extension ".wal". Each segment starts
+// with the 8 bytes "MQTTWAL1", followed by the sessions as they were when
+// the segment was started, then the changes made since. Once a new
+// segment is complete on disk, the older ones are deleted. Each record is
+// an operation byte, the length of the body as a big-endian uint32, the
+// CRC-32 (IEEE) of the body as a big-endian uint32, then the body. Its
+// integers are big-endian, and its strings are prefixed with their length
+// as a uint16:
+//
+//	'S' (session):      client id, Session Expiry Interval uint32
+//	'X' (end):          client id
+//	'U' (subscribe):    client id, topic filter, QoS byte, options byte as
+//	                    in an MQTT 5 SUBSCRIBE without the QoS, Subscription
+//	                    Identifier uint32
+//	'N' (unsubscribe):  client id, topic filter
+//	'Q' (message):      client id, message id uint64, packet id uint16,
+//	                    PUBREC received byte, expiry time int64 in Unix
+//	                    nanoseconds or 0 for never, then the message as an
+//	                    MQTT 5 PUBLISH
+//	'F' (state):        client id, message id uint64, packet id uint16,
+//	                    PUBREC received byte; the message is that of the
+//	                    last 'Q' record with the same id
+//	'A' (ack):          client id, message id uint64; the message is gone,
+//	                    whether acknowledged by the client or dropped
+//
+// A record cut short at the end of the last segment, as a crash may leave
+// it, is dropped when the log is opened.
+type WAL struct {
+	dir  string
+	opts WALOptions
+
+	mu       sync.Mutex // guards the fields below
+	f        *os.File
+	segment  uint64 // sequence number of the current segment
+	size     int64  // of the current segment
+	base     int64  // size of the current segment once started
+	dirty    bool   // written since the last sync
+	sessions map[string]*memorySession
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+var walMagic = []byte("MQTTWAL1")
+
+const (
+	walOpSession     = 'S'
+	walOpEnd         = 'X'
+	walOpSubscribe   = 'U'
+	walOpUnsubscribe = 'N'
+	walOpMessage     = 'Q'
+	walOpState       = 'F'
+	walOpAck         = 'A'
+	walRecordMax     = 1 << 28
+)
+
+// OpenWAL opens the write-ahead log in dir, creating the directory if it
+// does not exist, and replays it.
+func OpenWAL(dir string, opts WALOptions) (*WAL, error) {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = 64 << 20
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	w := &WAL{
+		dir:      dir,
+		opts:     opts,
+		sessions: make(map[string]*memorySession),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+	go w.syncer()
+	return w, nil
+}
+
+func (w *WAL) segmentPath(n uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%016x.wal", n))
+}
+
+// The sequence numbers of the segments in the directory, in order.
+func (w *WAL) segments() ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(w.dir, "*.wal"))
+	if err != nil {
+		return nil, err
+	}
+	var list []uint64
+	for _, name := range names {
+		var n uint64
+		if _, err := fmt.Sscanf(filepath.Base(name), "%016x.wal", &n); err == nil {
+			list = append(list, n)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list, nil
+}
+
+// Replay the segments, then start a new one holding the live state.
+func (w *WAL) load() error {
+	list, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for i, n := range list {
+		last := i == len(list)-1
+		if err := w.replay(w.segmentPath(n), last); err != nil {
+			return err
+		}
+		w.segment = n
+	}
+	return w.roll()
+}
+
+// Apply the records of a segment to the state. A bad record ends the
+// last segment, which a crash may have cut short; in the others it is an
+// error.
+func (w *WAL) replay(path string, last bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(walMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, walMagic) {
+		if last {
+			return nil
+		}
+		return fmt.Errorf("%s: not a write-ahead log segment", path)
+	}
+	var head [9]byte
+	for {
+		_, err := io.ReadFull(r, head[:])
+		if err == io.EOF {
+			return nil
+		}
+		var body []byte
+		if err == nil {
+			n := binary.BigEndian.Uint32(head[1:])
+			if n > walRecordMax {
+				err = errors.New("record too large")
+			} else {
+				body = make([]byte, n)
+				_, err = io.ReadFull(r, body)
+			}
+		}
+		if err == nil && crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(head[5:]) {
+			err = errors.New("bad checksum")
+		}
+		if err == nil {
+			err = w.apply(head[0], body)
+		}
+		if err != nil {
+			if last {
+				log.Printf("NOTICE: dropped the end of %s - %s", path, err)
+				return nil
+			}
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+}
+
+// Apply a record to the state. Records about sessions that are gone are
+// ignored, as replaying a segment started while an older one was being
+// deleted repeats some.
+func (w *WAL) apply(op byte, body []byte) error {
+	d := &walDecoder{r: bytes.NewReader(body)}
+	clientid := d.string()
+	s := w.sessions[clientid]
+	switch op {
+	case walOpSession:
+		var expiry uint32
+		d.read(&expiry)
+		if d.err == nil {
+			w.putSession(clientid, expiry)
+		}
+	case walOpEnd:
+		delete(w.sessions, clientid)
+	case walOpSubscribe:
+		sub := d.subscription()
+		if d.err == nil && s != nil {
+			s.subs[sub.Filter] = sub
+		}
+	case walOpUnsubscribe:
+		filter := d.string()
+		if d.err == nil && s != nil {
+			delete(s.subs, filter)
+		}
+	case walOpMessage:
+		msg := d.fullMessage()
+		if d.err == nil && s != nil {
+			s.messages[msg.ID] = msg
+		}
+	case walOpState:
+		msg := d.message()
+		if old, ok := s.message(msg.ID); ok && d.err == nil {
+			msg.Message, msg.Expires = old.Message, old.Expires
+			s.messages[msg.ID] = msg
+		}
+	case walOpAck:
+		var id uint64
+		d.read(&id)
+		if d.err == nil && s != nil {
+			delete(s.messages, id)
+		}
+	default:
+		return fmt.Errorf("unknown record %q", op)
+	}
+	return d.err
+}
+
+// The caller must hold w.mu, or be loading the log.
+func (w *WAL) putSession(clientid string, expiry uint32) {
+	if s, ok := w.sessions[clientid]; ok {
+		s.expiry = expiry
+		return
+	}
+	w.sessions[clientid] = newMemorySession(expiry)
+}
+
+func (s *memorySession) message(id uint64) (StoredMessage, bool) {
+	if s == nil {
+		return StoredMessage{}, false
+	}
+	msg, ok := s.messages[id]
+	return msg, ok
+}
+
+// Start a new segment holding the live state, and delete the older ones
+// once it is on disk. The caller must hold w.mu.
+func (w *WAL) roll() error {
+	n := w.segment + 1
+	f, err := os.OpenFile(w.segmentPath(n), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	size := int64(len(walMagic))
+	bw.Write(walMagic)
+	write := func(op byte, e *walEncoder) {
+		if err == nil {
+			err = writeRecord(bw, op, e.Bytes())
+			size += int64(9 + e.Len())
+		}
+	}
+	clientids := make([]string, 0, len(w.sessions))
+	for clientid := range w.sessions {
+		clientids = append(clientids, clientid)
+	}
+	sort.Strings(clientids)
+	for _, clientid := range clientids {
+		s := w.sessions[clientid]
+		write(walOpSession, sessionRecord(clientid, s.expiry))
+		for _, sub := range s.subscriptions() {
+			write(walOpSubscribe, subscriptionRecord(clientid, sub))
+		}
+		for _, msg := range s.messageList() {
+			e, merr := messageRecord(walOpMessage, clientid, msg)
+			if err == nil {
+				err = merr
+			}
+			write(walOpMessage, e)
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = syncDir(w.dir)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(w.segmentPath(n))
+		return err
+	}
+
+	if w.f != nil {
+		w.f.Close()
+	}
+	w.f, w.segment, w.size, w.base, w.dirty = f, n, size, size, false
+	list, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, old := range list {
+		if old < n {
+			if err := os.Remove(w.segmentPath(old)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func writeRecord(w io.Writer, op byte, body []byte) error {
+	rec := make([]byte, 9, 9+len(body))
+	rec[0] = op
+	binary.BigEndian.PutUint32(rec[1:], uint32(len(body)))
+	binary.BigEndian.PutUint32(rec[5:], crc32.ChecksumIEEE(body))
+	_, err := w.Write(append(rec, body...))
+	return err
+}
+
+// A walEncoder builds the body of a record.
+type walEncoder struct {
+	bytes.Buffer
+}
+
+func (e *walEncoder) write(v interface{}) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *walEncoder) string(s string) {
+	e.write(uint16(len(s)))
+	e.WriteString(s)
+}
+
+// A walDecoder reads the body of a record, keeping the first error.
+type walDecoder struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (d *walDecoder) read(v interface{}) {
+	if d.err == nil {
+		d.err = binary.Read(d.r, binary.BigEndian, v)
+	}
+}
+
+func (d *walDecoder) string() string {
+	var n uint16
+	d.read(&n)
+	if d.err != nil {
+		return ""
+	}
+	b := make([]byte, n)
+	_, d.err = io.ReadFull(d.r, b)
+	return string(b)
+}
+
+func (d *walDecoder) rest() []byte {
+	b := make([]byte, d.r.Len())
+	d.r.Read(b)
+	return b
+}
+
+func (d *walDecoder) subscription() StoredSubscription {
+	var sub StoredSubscription
+	var opts byte
+	var id uint32
+	sub.Filter = d.string()
+	d.read(&sub.QoS)
+	d.read(&opts)
+	d.read(&id)
+	sub.Options = packets.SubscriptionOptions{
+		NoLocal:           opts&(1<<2) != 0,
+		RetainAsPublished: opts&(1<<3) != 0,
+		RetainHandling:    opts >> 4 & 3,
+	}
+	sub.Identifier = int(id)
+	return sub
+}
+
+func (d *walDecoder) message() StoredMessage {
+	var msg StoredMessage
+	var pubrel byte
+	d.read(&msg.ID)
+	d.read(&msg.PacketID)
+	d.read(&pubrel)
+	msg.Pubrel = pubrel != 0
+	return msg
+}
+
+// Read the rest of a walOpMessage record, after the client id.
+func (d *walDecoder) fullMessage() StoredMessage {
+	msg := d.message()
+	var expires int64
+	d.read(&expires)
+	if expires != 0 {
+		msg.Expires = time.Unix(0, expires)
+	}
+	if d.err == nil {
+		msg.Message, d.err = readPublish(d.rest())
+	}
+	return msg
+}
+
+func sessionRecord(clientid string, expiry uint32) *walEncoder {
+	e := &walEncoder{}
+	e.string(clientid)
+	e.write(expiry)
+	return e
+}
+
+func subscriptionRecord(clientid string, sub StoredSubscription) *walEncoder {
+	e := &walEncoder{}
+	e.string(clientid)
+	e.string(sub.Filter)
+	opts := sub.Options.RetainHandling << 4
+	if sub.Options.NoLocal {
+		opts |= 1 << 2
+	}
+	if sub.Options.RetainAsPublished {
+		opts |= 1 << 3
+	}
+	e.write([]byte{sub.QoS, opts})
+	e.write(uint32(sub.Identifier))
+	return e
+}
+
+// A record of a message: its state only for walOpState, all of it for
+// walOpMessage.
+func messageRecord(op byte, clientid string, msg StoredMessage) (*walEncoder, error) {
+	e := &walEncoder{}
+	e.string(clientid)
+	e.write(msg.ID)
+	e.write(msg.PacketID)
+	var pubrel byte
+	if msg.Pubrel {
+		pubrel = 1
+	}
+	e.write(pubrel)
+	if op == walOpState {
+		return e, nil
+	}
+	var expires int64
+	if !msg.Expires.IsZero() {
+		expires = msg.Expires.UnixNano()
+	}
+	e.write(expires)
+	return e, writePublish(e, msg.Message)
+}
+
+func clientRecord(clientid string) *walEncoder {
+	e := &walEncoder{}
+	e.string(clientid)
+	return e
+}
+
+// Write a message as an MQTT 5 PUBLISH, which carries all of its
+// properties, for the logs kept on disk. The packet id is left out.
+func writePublish(w io.Writer, m *packets.PublishPacket) error {
+	p := copyPublish(m)
+	if m.Properties != nil && len(m.Properties.SubscriptionIdentifier) > 0 {
+		if p.Properties == nil {
+			p.Properties = &packets.Properties{}
+		}
+		p.Properties.SubscriptionIdentifier = m.Properties.SubscriptionIdentifier
+	}
+	p.SetVersion(packets.Version5)
+	return p.WriteTo(w)
+}
+
+// Read a message written by writePublish.
+func readPublish(b []byte) (*packets.PublishPacket, error) {
+	cp, err := packets.ReadPacketVersion(bytes.NewReader(b), packets.Version5)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := cp.(*packets.PublishPacket)
+	if !ok {
+		return nil, errors.New("not a PUBLISH")
+	}
+	return m, nil
+}
+
+// Append a record and sync it if the policy says so, then apply the
+// change to the state. A new segment is started once the current one has
+// grown enough. The caller must hold w.mu.
+func (w *WAL) commit(op byte, e *walEncoder, apply func()) error {
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	if err := writeRecord(w.f, op, e.Bytes()); err != nil {
+		return err
+	}
+	w.size += int64(9 + e.Len())
+	w.dirty = true
+	apply()
+	if w.opts.Fsync == FsyncAlways {
+		if err := w.sync(); err != nil {
+			return err
+		}
+	}
+	if w.size-w.base >= w.opts.SegmentSize {
+		// The record is in; a new segment can wait for the next one.
+		if err := w.roll(); err != nil {
+			log.Printf("ERROR: failed to start a write-ahead log segment - %s", err)
+		}
+	}
+	return nil
+}
+
+// The caller must hold w.mu.
+func (w *WAL) sync() error {
+	w.dirty = false
+	return w.f.Sync()
+}
+
+// Sync the log from time to time, under the interval policy.
+func (w *WAL) syncer() {
+	defer close(w.done)
+	if w.opts.Fsync != FsyncInterval {
+		<-w.stop
+		return
+	}
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.f != nil && w.dirty {
+				if err := w.sync(); err != nil {
+					log.Printf("ERROR: failed to sync the write-ahead log - %s", err)
+				}
+			}
+			w.mu.Unlock()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Close syncs the log to disk and closes it.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	f := w.f
+	w.f = nil
+	w.mu.Unlock()
+	if f == nil {
+		return os.ErrClosed
+	}
+	close(w.stop)
+	<-w.done
+
+	err := f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// PutSession stores a session.
+func (w *WAL) PutSession(s StoredSession) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.commit(walOpSession, sessionRecord(s.ClientID, s.Expiry), func() {
+		w.putSession(s.ClientID, s.Expiry)
+	})
+}
+
+// DeleteSession removes a session.
+func (w *WAL) DeleteSession(clientid string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.sessions[clientid]; !ok {
+		return nil
+	}
+	return w.commit(walOpEnd, clientRecord(clientid), func() {
+		delete(w.sessions, clientid)
+	})
+}
+
+// Sessions calls f for each session.
+func (w *WAL) Sessions(f func(StoredSession) bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for clientid, s := range w.sessions {
+		if !f(StoredSession{ClientID: clientid, Expiry: s.expiry}) {
+			break
+		}
+	}
+	return nil
+}
+
+// PutSubscription stores a subscription of a session.
+func (w *WAL) PutSubscription(clientid string, sub StoredSubscription) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s, ok := w.sessions[clientid]
+	if !ok {
+		return nil
+	}
+	return w.commit(walOpSubscribe, subscriptionRecord(clientid, sub), func() {
+		s.subs[sub.Filter] = sub
+	})
+}
+
+// DeleteSubscription removes a subscription of a session.
+func (w *WAL) DeleteSubscription(clientid string, filter string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s, ok := w.sessions[clientid]
+	if !ok {
+		return nil
+	}
+	if _, ok := s.subs[filter]; !ok {
+		return nil
+	}
+	e := clientRecord(clientid)
+	e.string(filter)
+	return w.commit(walOpUnsubscribe, e, func() {
+		delete(s.subs, filter)
+	})
+}
+
+// Subscriptions returns the subscriptions of a session.
+func (w *WAL) Subscriptions(clientid string) ([]StoredSubscription, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s, ok := w.sessions[clientid]
+	if !ok {
+		return nil, nil
+	}
+	return s.subscriptions(), nil
+}
+
+// PutMessage stores a message of a session. When only its packet id or
+// PUBREC state changed, only those are logged.
+func (w *WAL) PutMessage(clientid string, msg StoredMessage) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s, ok := w.sessions[clientid]
+	if !ok {
+		return nil
+	}
+	op := byte(walOpMessage)
+	if old, ok := s.messages[msg.ID]; ok && old.Message == msg.Message && old.Expires.Equal(msg.Expires) {
+		op = walOpState
+	}
+	e, err := messageRecord(op, clientid, msg)
+	if err != nil {
+		return err
+	}
+	return w.commit(op, e, func() {
+		s.messages[msg.ID] = msg
+	})
+}
+
+// DeleteMessage removes a message of a session.
+func (w *WAL) DeleteMessage(clientid string, id uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s, ok := w.sessions[clientid]
+	if !ok {
+		return nil
+	}
+	if _, ok := s.messages[id]; !ok {
+		return nil
+	}
+	e := clientRecord(clientid)
+	e.write(id)
+	return w.commit(walOpAck, e, func() {
+		delete(s.messages, id)
+	})
+}
+
+// Messages returns the messages of a session, ordered by id.
+func (w *WAL) Messages(clientid string) ([]StoredMessage, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s, ok := w.sessions[clientid]
+	if !ok {
+		return nil, nil
+	}
+	return s.messageList(), nil
+}
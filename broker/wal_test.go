@@ -0,0 +1,158 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func openTestWAL(t *testing.T, dir string, opts WALOptions) *WAL {
+	t.Helper()
+	w, err := OpenWAL(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// The ids of the messages of a session in a WAL.
+func messageIDs(t *testing.T, w *WAL, clientid string) []uint64 {
+	t.Helper()
+	msgs, err := w.Messages(clientid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint64
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func putTestMessage(t *testing.T, w *WAL, clientid string, id uint64) {
+	t.Helper()
+	if err := w.PutMessage(clientid, StoredMessage{ID: id, Message: newPublish(0, "t", 1, "payload")}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A record for message id 2 of session a, as the WAL writes it.
+func testRecord(t *testing.T) []byte {
+	t.Helper()
+	e, err := messageRecord(walOpMessage, "a", StoredMessage{ID: 2, Message: newPublish(0, "t", 1, "payload")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	writeRecord(&b, walOpMessage, e.Bytes())
+	return b.Bytes()
+}
+
+func TestWALBadTail(t *testing.T) {
+	rec := testRecord(t)
+	huge := append([]byte(nil), rec...)
+	binary.BigEndian.PutUint32(huge[1:], 0xFFFFFFFF)
+	corrupt := append([]byte(nil), rec...)
+	corrupt[len(corrupt)-1]++
+	tails := map[string][]byte{
+		"torn header": rec[:5],
+		"torn body":   rec[:len(rec)-3],
+		"corrupt":     corrupt,
+		"huge length": huge[:20],
+	}
+	for name, tail := range tails {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			w := openTestWAL(t, dir, WALOptions{Fsync: FsyncAlways})
+			w.PutSession(StoredSession{ClientID: "a", Expiry: 60})
+			putTestMessage(t, w, "a", 1)
+			w.Close()
+
+			// A crash leaves a record cut short or garbled at the end
+			// of the last segment.
+			list, _ := w.segments()
+			f, err := os.OpenFile(w.segmentPath(list[len(list)-1]), os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(tail)
+			f.Close()
+
+			w = openTestWAL(t, dir, WALOptions{Fsync: FsyncAlways})
+			if got := messageIDs(t, w, "a"); !reflect.DeepEqual(got, []uint64{1}) {
+				t.Fatalf("messages %v after reopening, want [1]", got)
+			}
+			// What comes after is kept, past the dropped record.
+			putTestMessage(t, w, "a", 3)
+			w.Close()
+			w = openTestWAL(t, dir, WALOptions{})
+			defer w.Close()
+			if got := messageIDs(t, w, "a"); !reflect.DeepEqual(got, []uint64{1, 3}) {
+				t.Fatalf("messages %v after reopening again, want [1 3]", got)
+			}
+		})
+	}
+}
+
+func TestWALBadOlderSegment(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, WALOptions{})
+	w.PutSession(StoredSession{ClientID: "a", Expiry: 60})
+	w.Close()
+
+	// Only the last segment may end badly: in an older one, a bad record
+	// means a damaged log.
+	list, _ := w.segments()
+	last := list[len(list)-1]
+	b, err := os.ReadFile(w.segmentPath(last))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(w.segmentPath(last+1), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(w.segmentPath(last), append(b, testRecord(t)[:5]...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if w, err := OpenWAL(dir, WALOptions{}); err == nil {
+		w.Close()
+		t.Fatal("opened a log with a damaged older segment")
+	}
+}
+
+func TestWALSegmentRoll(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, WALOptions{SegmentSize: 512})
+	first, _ := w.segments()
+	w.PutSession(StoredSession{ClientID: "a", Expiry: 60})
+	for id := uint64(1); id <= 50; id++ {
+		putTestMessage(t, w, "a", id)
+		if id > 3 {
+			if err := w.DeleteMessage("a", id-3); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// New segments hold the live state only, and the older ones are gone.
+	list, _ := w.segments()
+	if len(list) != 1 || list[0] <= first[0]+1 {
+		t.Fatalf("segments %v, want a single one well after %v", list, first)
+	}
+	fi, err := os.Stat(w.segmentPath(list[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > 1024 {
+		t.Fatalf("segment of %d bytes, want the live state and a few records", fi.Size())
+	}
+	w.Close()
+
+	w = openTestWAL(t, dir, WALOptions{SegmentSize: 512})
+	defer w.Close()
+	if got := messageIDs(t, w, "a"); !reflect.DeepEqual(got, []uint64{48, 49, 50}) {
+		t.Fatalf("messages %v after reopening, want [48 49 50]", got)
+	}
+}
@@ -4,11 +4,6 @@ import (
 	"strings"
 )
 
-type wild struct {
-	wild []string
-	c    *incomingConn
-}
-
 func isWildcard(topic string) bool {
 	if strings.Contains(topic, "#") || strings.Contains(topic, "+") {
 		return true
@@ -16,47 +11,25 @@ func isWildcard(topic string) bool {
 	return false
 }
 
-func newWild(topic string, c *incomingConn) wild {
-	return wild{wild: strings.Split(topic, "/"), c: c}
-}
-
-func (w wild) matches(parts []string) bool {
-	i := 0
-	for i < len(parts) {
-		// topic is longer, no match
-		if i >= len(w.wild) {
+// validFilter reports whether a topic filter can be subscribed to.
+func validFilter(topic string) bool {
+	if group, filter, ok := parseShare(topic); ok {
+		if group == "" || isWildcard(group) {
 			return false
 		}
-		// matched up to here, and now the wildcard says "all others will match"
-		if w.wild[i] == "#" {
-			return true
-		}
-		// text does not match, and there wasn't a + to excuse it
-		if parts[i] != w.wild[i] && w.wild[i] != "+" {
-			return false
-		}
-		i++
+		topic = filter
 	}
-
-	// make finance/stock/ibm/# match finance/stock/ibm
-	if i == len(w.wild)-1 && w.wild[len(w.wild)-1] == "#" {
-		return true
-	}
-
-	if i == len(w.wild) {
-		return true
+	if topic == "" {
+		return false
 	}
-	return false
-}
-
-func (w wild) valid() bool {
-	for i, part := range w.wild {
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
 		// catch things like finance#
-		if isWildcard(part) && len(part) != 1 {
+		if isWildcard(level) && len(level) != 1 {
 			return false
 		}
-		// # can only occur as the last part
-		if part == "#" && i != len(w.wild)-1 {
+		// # can only occur as the last level
+		if level == "#" && i != len(levels)-1 {
 			return false
 		}
 	}
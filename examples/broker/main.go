@@ -1,6 +1,10 @@
 package main
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
+	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
@@ -8,16 +12,83 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
 
 	"github.com/zwczou/mqtt/broker"
 )
 
+var (
+	passwdFile = flag.String("passwd", "", "mosquitto password file used to authenticate clients")
+	aclFile    = flag.String("acl", "", "mosquitto acl file used to authorize publish and subscribe")
+	scramFile  = flag.String("scram", "", "SCRAM-SHA-256 credential file offered to MQTT 5 clients")
+	storeDir   = flag.String("store", "", "directory keeping sessions and retained messages across restarts and crashes")
+	fsync      = flag.String("fsync", "interval", "when the store is synced to disk: always, interval or never")
+	queueBytes = flag.Int("queue-bytes", 0, "limit of the bytes queued per session, 0 for none")
+	dropOldest = flag.Bool("drop-oldest", false, "drop the oldest queued messages, rather than new ones, when a queue is full")
+	snapFile   = flag.String("snapshot", "broker.snap", "file a snapshot is written to on SIGUSR1")
+	restore    = flag.String("restore", "", "snapshot to restore before starting")
+	tlsAddr    = flag.String("tls-addr", ":8883", "address of the TLS listener, when -tls-cert is set")
+	tlsCert    = flag.String("tls-cert", "", "PEM certificate chain of the TLS listener, reloaded on SIGHUP")
+	tlsKey     = flag.String("tls-key", "", "PEM private key of the TLS listener, reloaded on SIGHUP")
+	tlsCA      = flag.String("tls-ca", "", "PEM CA certificates verifying client certificates, for mutual TLS")
+	tlsRequire = flag.Bool("tls-require-cert", false, "refuse TLS clients without a client certificate")
+	tlsCiphers = flag.String("tls-ciphers", "", "comma separated TLS 1.2 cipher suites, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	certID     = flag.String("cert-identity", "none", "what a client certificate names: none, username or clientid")
+	adminAddr  = flag.String("admin", "127.0.0.1:6060", "address of the pprof and admin endpoint")
+	adminToken = flag.String("admin-token", "", "bearer token a client must send to download a snapshot; none if empty")
+)
+
+// Parse a list of cipher suite names.
+func cipherSuites(list string) ([]uint16, error) {
+	if list == "" {
+		return nil, nil
+	}
+	byName := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		byName[cs.Name] = cs.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		id, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Write a snapshot to a file, through a temporary file so that a failure
+// does not spoil the last good one.
+func writeSnapshot(svr *broker.Server, path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = svr.Snapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
 func main() {
+	flag.Parse()
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	// see godoc net/http/pprof
 	go func() {
-		log.Println(http.ListenAndServe("0.0.0.0:6060", nil))
+		log.Println(http.ListenAndServe(*adminAddr, nil))
 	}()
 
 	l, err := net.Listen("tcp", ":1883")
@@ -26,10 +97,134 @@ func main() {
 		return
 	}
 
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	svr := broker.NewServer(l)
+	if *passwdFile != "" {
+		svr.Auth, err = broker.NewPasswordFile(*passwdFile)
+		if err != nil {
+			log.Printf("ERROR: failed to load password file - %s", err)
+			return
+		}
+	}
+	if *scramFile != "" {
+		scram, err := broker.NewScramSHA256File(*scramFile)
+		if err != nil {
+			log.Printf("ERROR: failed to load scram file - %s", err)
+			return
+		}
+		svr.AuthMethods = append(svr.AuthMethods, scram)
+	}
+	if *aclFile != "" {
+		svr.Authz, err = broker.NewACLFile(*aclFile)
+		if err != nil {
+			log.Printf("ERROR: failed to load acl file - %s", err)
+			return
+		}
+	}
+
+	if *storeDir != "" {
+		var opts broker.WALOptions
+		switch *fsync {
+		case "always":
+			opts.Fsync = broker.FsyncAlways
+		case "interval":
+			opts.Fsync = broker.FsyncInterval
+		case "never":
+			opts.Fsync = broker.FsyncNever
+		default:
+			log.Printf("ERROR: unknown fsync policy %q", *fsync)
+			return
+		}
+		store, err := broker.OpenFileStore(*storeDir, opts)
+		if err != nil {
+			log.Printf("ERROR: failed to open store - %s", err)
+			return
+		}
+		defer store.Close()
+		svr.Store = store
+	}
+	if *tlsCert != "" {
+		ciphers, err := cipherSuites(*tlsCiphers)
+		if err != nil {
+			log.Printf("ERROR: %s", err)
+			return
+		}
+		tl, err := broker.ListenTLS(*tlsAddr, broker.TLSOptions{
+			CertFile:          *tlsCert,
+			KeyFile:           *tlsKey,
+			ClientCAFile:      *tlsCA,
+			RequireClientCert: *tlsRequire,
+			CipherSuites:      ciphers,
+		})
+		if err != nil {
+			log.Printf("ERROR: failed to listen for TLS - %s", err)
+			return
+		}
+		svr.AddListener(tl)
+	}
+	switch *certID {
+	case "none":
+	case "username":
+		svr.CertIdentity = broker.CertIdentityUsername
+	case "clientid":
+		svr.CertIdentity = broker.CertIdentityClientID
+	default:
+		log.Printf("ERROR: unknown cert identity %q", *certID)
+		return
+	}
+	svr.MaxQueuedBytes = *queueBytes
+	if *dropOldest {
+		svr.QueuePolicy = broker.QueueDropOldest
+	}
+
+	if *restore != "" {
+		f, err := os.Open(*restore)
+		if err != nil {
+			log.Printf("ERROR: failed to open snapshot - %s", err)
+			return
+		}
+		err = svr.Restore(f)
+		f.Close()
+		if err != nil {
+			log.Printf("ERROR: failed to restore %s - %s", *restore, err)
+			return
+		}
+		log.Printf("INFO: restored %s", *restore)
+	}
+
+	// admin endpoint, next to pprof: GET /snapshot downloads a snapshot,
+	// given the token if one is set
+	http.HandleFunc("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		if *adminToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+*adminToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if err := svr.Snapshot(w); err != nil {
+			log.Printf("ERROR: failed to write snapshot - %s", err)
+		}
+	})
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 	svr.Start()
-	<-signalChan
+	for sig := range signalChan {
+		switch sig {
+		case syscall.SIGHUP:
+			if err := svr.Reload(); err != nil {
+				log.Printf("ERROR: failed to reload - %s", err)
+			} else {
+				log.Printf("INFO: reloaded password, scram and acl files, and certificates")
+			}
+			continue
+		case syscall.SIGUSR1:
+			if err := writeSnapshot(svr, *snapFile); err != nil {
+				log.Printf("ERROR: failed to write snapshot - %s", err)
+			} else {
+				log.Printf("INFO: wrote snapshot to %s", *snapFile)
+			}
+			continue
+		}
+		break
+	}
 	svr.Stop()
 }
@@ -0,0 +1,144 @@
+// Command snapshot takes a snapshot of a running broker through its admin
+// endpoint, and prints what a snapshot holds, offline.
+//
+//	snapshot -fetch http://localhost:6060/snapshot [-token secret] -o broker.snap
+//	snapshot [-v] broker.snap
+//
+// A broker from examples/broker also writes a snapshot on SIGUSR1.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/zwczou/mqtt/broker"
+)
+
+var (
+	fetch   = flag.String("fetch", "", "URL of the admin endpoint of a broker to take a snapshot from")
+	token   = flag.String("token", "", "token of the admin endpoint, as set with the broker's -admin-token")
+	out     = flag.String("o", "broker.snap", "file the fetched snapshot is written to")
+	verbose = flag.Bool("v", false, "list every subscription and message, not only counts")
+)
+
+func main() {
+	flag.Parse()
+	switch {
+	case *fetch != "":
+		if err := fetchSnapshot(*fetch, *token, *out); err != nil {
+			log.Fatalf("ERROR: failed to fetch snapshot - %s", err)
+		}
+		log.Printf("INFO: wrote snapshot to %s", *out)
+	case flag.NArg() == 1:
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		snap, err := broker.ReadSnapshot(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("ERROR: %s: %s", flag.Arg(0), err)
+		}
+		inspect(os.Stdout, snap)
+	default:
+		fmt.Fprintln(os.Stderr, "usage: snapshot -fetch url [-token token] [-o file] | snapshot [-v] file")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+}
+
+// Download a snapshot, and check it reads before keeping it.
+func fetchSnapshot(url, token, path string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if _, err := broker.ReadSnapshot(bytes.NewReader(b)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+func inspect(w io.Writer, snap *broker.Snapshot) {
+	var subs, msgs, inflight int
+	for _, ss := range snap.Sessions {
+		subs += len(ss.Subscriptions)
+		msgs += len(ss.Messages)
+		for _, m := range ss.Messages {
+			if m.PacketID != 0 {
+				inflight++
+			}
+		}
+	}
+	fmt.Fprintf(w, "version %d, taken %s\n", snap.Version, snap.Taken.Format(time.RFC3339))
+	fmt.Fprintf(w, "%d sessions, %d subscriptions, %d messages (%d in flight), %d retained\n",
+		len(snap.Sessions), subs, msgs, inflight, len(snap.Retained))
+
+	for _, ss := range snap.Sessions {
+		fmt.Fprintf(w, "\nsession %q expiry %s: %d subscriptions, %d messages\n",
+			ss.ClientID, expiry(ss.Expiry), len(ss.Subscriptions), len(ss.Messages))
+		if !*verbose {
+			continue
+		}
+		for _, sub := range ss.Subscriptions {
+			fmt.Fprintf(w, "  subscription %q qos %d", sub.Filter, sub.QoS)
+			if sub.Identifier != 0 {
+				fmt.Fprintf(w, " id %d", sub.Identifier)
+			}
+			fmt.Fprintln(w)
+		}
+		for _, m := range ss.Messages {
+			fmt.Fprintf(w, "  message %d %q qos %d, %d bytes", m.ID, m.Message.TopicName, m.Message.Qos, len(m.Message.Payload))
+			if m.PacketID != 0 {
+				fmt.Fprintf(w, ", in flight as %d", m.PacketID)
+				if m.Pubrel {
+					fmt.Fprint(w, ", awaiting PUBCOMP")
+				}
+			}
+			if !m.Expires.IsZero() {
+				fmt.Fprintf(w, ", expires %s", m.Expires.Format(time.RFC3339))
+			}
+			fmt.Fprintln(w)
+		}
+	}
+
+	if len(snap.Retained) > 0 {
+		fmt.Fprintln(w, "\nretained")
+	}
+	for _, r := range snap.Retained {
+		fmt.Fprintf(w, "  %q qos %d, %d bytes", r.Message.TopicName, r.Message.Qos, len(r.Message.Payload))
+		if !r.Expires.IsZero() {
+			fmt.Fprintf(w, ", expires %s", r.Expires.Format(time.RFC3339))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func expiry(s uint32) string {
+	if s == 0xFFFFFFFF {
+		return "never"
+	}
+	return (time.Duration(s) * time.Second).String()
+}
@@ -0,0 +1,39 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// An AuthPacket carries the exchanges of MQTT 5 enhanced authentication.
+type AuthPacket struct {
+	FixedHeader
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (a *AuthPacket) String() string {
+	str := fmt.Sprintf("%s\n", a.FixedHeader)
+	str += fmt.Sprintf("reasoncode: %d\n%s\n", a.ReasonCode, a.Properties)
+	return str
+}
+
+func (a *AuthPacket) WriteTo(w io.Writer) error {
+	body := packReason(a.ReasonCode, a.Properties)
+	a.FixedHeader.RemainingLength = len(body)
+	packet := a.FixedHeader.pack()
+	packet.Write(body)
+	_, err := packet.WriteTo(w)
+
+	return err
+}
+
+func (a *AuthPacket) ReadFrom(r io.Reader) error {
+	var err error
+	a.ReasonCode, a.Properties, err = unpackReason(r, a.FixedHeader.RemainingLength)
+	return err
+}
+
+func (a *AuthPacket) Details() Details {
+	return Details{Qos: 0, PacketID: 0}
+}
@@ -8,13 +8,18 @@ import (
 
 type ConnackPacket struct {
 	FixedHeader
-	TopicNameCompression byte
-	ReturnCode           byte
+	SessionPresent bool
+	ReturnCode     byte // the reason code for MQTT 5
+
+	Properties *Properties // MQTT 5 only
 }
 
 func (ca *ConnackPacket) String() string {
 	str := fmt.Sprintf("%s\n", ca.FixedHeader)
-	str += fmt.Sprintf("returncode: %d", ca.ReturnCode)
+	str += fmt.Sprintf("sessionpresent: %t returncode: %d", ca.SessionPresent, ca.ReturnCode)
+	if ca.v5() {
+		str += fmt.Sprintf("\n%s", ca.Properties)
+	}
 	return str
 }
 
@@ -22,9 +27,12 @@ func (ca *ConnackPacket) WriteTo(w io.Writer) error {
 	var body bytes.Buffer
 	var err error
 
-	body.WriteByte(ca.TopicNameCompression)
+	body.WriteByte(boolToByte(ca.SessionPresent))
 	body.WriteByte(ca.ReturnCode)
-	ca.FixedHeader.RemainingLength = 2
+	if ca.v5() {
+		body.Write(ca.Properties.pack())
+	}
+	ca.FixedHeader.RemainingLength = body.Len()
 	packet := ca.FixedHeader.pack()
 	packet.Write(body.Bytes())
 	_, err = packet.WriteTo(w)
@@ -33,13 +41,19 @@ func (ca *ConnackPacket) WriteTo(w io.Writer) error {
 }
 
 func (ca *ConnackPacket) ReadFrom(r io.Reader) error {
-	var err error
-
-	ca.TopicNameCompression, err = decodeByte(r)
+	flags, err := decodeByte(r)
 	if err != nil {
 		return err
 	}
+	ca.SessionPresent = 1&flags > 0
 	ca.ReturnCode, err = decodeByte(r)
+	if err != nil {
+		return err
+	}
+	if ca.v5() {
+		ca.Properties = &Properties{}
+		_, err = ca.Properties.unpack(r, ca.FixedHeader.RemainingLength-2)
+	}
 	return err
 }
 
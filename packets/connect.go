@@ -24,11 +24,18 @@ type ConnectPacket struct {
 	WillMessage      []byte
 	Username         string
 	Password         []byte
+
+	// MQTT 5 only.
+	Properties     *Properties
+	WillProperties *Properties
 }
 
 func (c *ConnectPacket) String() string {
 	str := fmt.Sprintf("%s\n", c.FixedHeader)
 	str += fmt.Sprintf("protocolversion: %d protocolname: %s cleansession: %t willflag: %t WillQos: %d WillRetain: %t Usernameflag: %t Passwordflag: %t keepalivetimer: %d\nclientId: %s\nwilltopic: %s\nwillmessage: %s\nUsername: %s\nPassword: %s\n", c.ProtocolVersion, c.ProtocolName, c.CleanSession, c.WillFlag, c.WillQos, c.WillRetain, c.UsernameFlag, c.PasswordFlag, c.KeepaliveTimer, c.ClientIdentifier, c.WillTopic, c.WillMessage, c.Username, c.Password)
+	if c.ProtocolVersion == Version5 {
+		str += fmt.Sprintf("%s\nwill %s\n", c.Properties, c.WillProperties)
+	}
 	return str
 }
 
@@ -40,8 +47,14 @@ func (c *ConnectPacket) WriteTo(w io.Writer) error {
 	body.WriteByte(c.ProtocolVersion)
 	body.WriteByte(boolToByte(c.CleanSession)<<1 | boolToByte(c.WillFlag)<<2 | c.WillQos<<3 | boolToByte(c.WillRetain)<<5 | boolToByte(c.PasswordFlag)<<6 | boolToByte(c.UsernameFlag)<<7)
 	body.Write(encodeUint16(c.KeepaliveTimer))
+	if c.ProtocolVersion == Version5 {
+		body.Write(c.Properties.pack())
+	}
 	body.Write(encodeString(c.ClientIdentifier))
 	if c.WillFlag {
+		if c.ProtocolVersion == Version5 {
+			body.Write(c.WillProperties.pack())
+		}
 		body.Write(encodeString(c.WillTopic))
 		body.Write(encodeBytes(c.WillMessage))
 	}
@@ -70,6 +83,9 @@ func (c *ConnectPacket) ReadFrom(r io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if c.ProtocolVersion == Version5 {
+		c.SetVersion(Version5)
+	}
 
 	options, err := decodeByte(r)
 	if err != nil {
@@ -87,11 +103,28 @@ func (c *ConnectPacket) ReadFrom(r io.Reader) error {
 	if err != nil {
 		return err
 	}
+	// bytes left after the protocol name, version, flags and keep alive
+	left := c.FixedHeader.RemainingLength - len(c.ProtocolName) - 6
+	if c.v5() {
+		c.Properties = &Properties{}
+		n, err := c.Properties.unpack(r, left)
+		if err != nil {
+			return err
+		}
+		left -= n
+	}
 	c.ClientIdentifier, err = decodeString(r)
 	if err != nil {
 		return err
 	}
+	left -= len(c.ClientIdentifier) + 2
 	if c.WillFlag {
+		if c.v5() {
+			c.WillProperties = &Properties{}
+			if _, err = c.WillProperties.unpack(r, left); err != nil {
+				return err
+			}
+		}
 		c.WillTopic, err = decodeString(r)
 		if err != nil {
 			return err
@@ -124,7 +157,7 @@ func (c *ConnectPacket) Validate() byte {
 		//Bad reserved bit
 		return ErrProtocolViolation
 	}
-	if (c.ProtocolName == "MQIsdp" && c.ProtocolVersion != 3) || (c.ProtocolName == "MQTT" && c.ProtocolVersion != 4) {
+	if (c.ProtocolName == "MQIsdp" && c.ProtocolVersion != Version31) || (c.ProtocolName == "MQTT" && c.ProtocolVersion != Version311 && c.ProtocolVersion != Version5) {
 		//Mismatched or unsupported protocol version
 		return ErrRefusedBadProtocolVersion
 	}
@@ -136,6 +169,12 @@ func (c *ConnectPacket) Validate() byte {
 		//Bad size field
 		return ErrProtocolViolation
 	}
+	if p := c.Properties; c.ProtocolVersion == Version5 && p != nil {
+		if p.ReceiveMaximum != nil && *p.ReceiveMaximum == 0 || p.MaximumPacketSize != nil && *p.MaximumPacketSize == 0 {
+			//Zero is not allowed for either
+			return ErrProtocolViolation
+		}
+	}
 	return Accepted
 }
 
@@ -7,22 +7,39 @@ import (
 
 type DisconnectPacket struct {
 	FixedHeader
+
+	// MQTT 5 only.
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (d *DisconnectPacket) String() string {
 	str := fmt.Sprintf("%s\n", d.FixedHeader)
+	if d.v5() {
+		str += fmt.Sprintf("reasoncode: %d\n%s\n", d.ReasonCode, d.Properties)
+	}
 	return str
 }
 
 func (d *DisconnectPacket) WriteTo(w io.Writer) error {
+	var body []byte
+	if d.v5() {
+		body = packReason(d.ReasonCode, d.Properties)
+	}
+	d.FixedHeader.RemainingLength = len(body)
 	packet := d.FixedHeader.pack()
+	packet.Write(body)
 	_, err := packet.WriteTo(w)
 
 	return err
 }
 
 func (d *DisconnectPacket) ReadFrom(r io.Reader) error {
-	return nil
+	var err error
+	if d.v5() {
+		d.ReasonCode, d.Properties, err = unpackReason(r, d.FixedHeader.RemainingLength)
+	}
+	return err
 }
 
 func (d *DisconnectPacket) Details() Details {
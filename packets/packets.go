@@ -18,8 +18,17 @@ type ControlPacket interface {
 	ReadFrom(io.Reader) error
 	String() string
 	Details() Details
+	Version() byte
+	SetVersion(byte)
 }
 
+// Protocol versions, as sent in the protocol level of CONNECT.
+const (
+	Version31  = 3
+	Version311 = 4
+	Version5   = 5
+)
+
 const (
 	Connect     = 1
 	Connack     = 2
@@ -35,6 +44,7 @@ const (
 	Pingreq     = 12
 	Pingresp    = 13
 	Disconnect  = 14
+	Auth        = 15
 )
 
 var PacketNames = map[uint8]string{
@@ -52,6 +62,7 @@ var PacketNames = map[uint8]string{
 	12: "PINGREQ",
 	13: "PINGRESP",
 	14: "DISCONNECT",
+	15: "AUTH",
 }
 
 const (
@@ -76,6 +87,125 @@ var ConnackReturnCodes = map[uint8]string{
 	255: "Connection Refused: Protocol Violation",
 }
 
+// Reason codes of MQTT 5, which replace the return codes of CONNACK,
+// SUBACK and the like, and extend PUBACK, PUBREC, PUBREL, PUBCOMP,
+// UNSUBACK, DISCONNECT and AUTH.
+const (
+	ReasonSuccess                             = 0x00
+	ReasonNormalDisconnection                 = 0x00
+	ReasonGrantedQoS0                         = 0x00
+	ReasonGrantedQoS1                         = 0x01
+	ReasonGrantedQoS2                         = 0x02
+	ReasonDisconnectWithWill                  = 0x04
+	ReasonNoMatchingSubscribers               = 0x10
+	ReasonNoSubscriptionExisted               = 0x11
+	ReasonContinueAuthentication              = 0x18
+	ReasonReAuthenticate                      = 0x19
+	ReasonUnspecifiedError                    = 0x80
+	ReasonMalformedPacket                     = 0x81
+	ReasonProtocolError                       = 0x82
+	ReasonImplementationSpecificError         = 0x83
+	ReasonUnsupportedProtocolVersion          = 0x84
+	ReasonClientIdentifierNotValid            = 0x85
+	ReasonBadUserNameOrPassword               = 0x86
+	ReasonNotAuthorized                       = 0x87
+	ReasonServerUnavailable                   = 0x88
+	ReasonServerBusy                          = 0x89
+	ReasonBanned                              = 0x8A
+	ReasonServerShuttingDown                  = 0x8B
+	ReasonBadAuthenticationMethod             = 0x8C
+	ReasonKeepAliveTimeout                    = 0x8D
+	ReasonSessionTakenOver                    = 0x8E
+	ReasonTopicFilterInvalid                  = 0x8F
+	ReasonTopicNameInvalid                    = 0x90
+	ReasonPacketIdentifierInUse               = 0x91
+	ReasonPacketIdentifierNotFound            = 0x92
+	ReasonReceiveMaximumExceeded              = 0x93
+	ReasonTopicAliasInvalid                   = 0x94
+	ReasonPacketTooLarge                      = 0x95
+	ReasonMessageRateTooHigh                  = 0x96
+	ReasonQuotaExceeded                       = 0x97
+	ReasonAdministrativeAction                = 0x98
+	ReasonPayloadFormatInvalid                = 0x99
+	ReasonRetainNotSupported                  = 0x9A
+	ReasonQoSNotSupported                     = 0x9B
+	ReasonUseAnotherServer                    = 0x9C
+	ReasonServerMoved                         = 0x9D
+	ReasonSharedSubscriptionsNotSupported     = 0x9E
+	ReasonConnectionRateExceeded              = 0x9F
+	ReasonMaximumConnectTime                  = 0xA0
+	ReasonSubscriptionIdentifiersNotSupported = 0xA1
+	ReasonWildcardSubscriptionsNotSupported   = 0xA2
+)
+
+var ReasonCodes = map[uint8]string{
+	0x00: "Success",
+	0x01: "Granted QoS 1",
+	0x02: "Granted QoS 2",
+	0x04: "Disconnect with Will Message",
+	0x10: "No matching subscribers",
+	0x11: "No subscription existed",
+	0x18: "Continue authentication",
+	0x19: "Re-authenticate",
+	0x80: "Unspecified error",
+	0x81: "Malformed Packet",
+	0x82: "Protocol Error",
+	0x83: "Implementation specific error",
+	0x84: "Unsupported Protocol Version",
+	0x85: "Client Identifier not valid",
+	0x86: "Bad User Name or Password",
+	0x87: "Not authorized",
+	0x88: "Server unavailable",
+	0x89: "Server busy",
+	0x8A: "Banned",
+	0x8B: "Server shutting down",
+	0x8C: "Bad authentication method",
+	0x8D: "Keep Alive timeout",
+	0x8E: "Session taken over",
+	0x8F: "Topic Filter invalid",
+	0x90: "Topic Name invalid",
+	0x91: "Packet Identifier in use",
+	0x92: "Packet Identifier not found",
+	0x93: "Receive Maximum exceeded",
+	0x94: "Topic Alias invalid",
+	0x95: "Packet too large",
+	0x96: "Message rate too high",
+	0x97: "Quota exceeded",
+	0x98: "Administrative action",
+	0x99: "Payload format invalid",
+	0x9A: "Retain not supported",
+	0x9B: "QoS not supported",
+	0x9C: "Use another server",
+	0x9D: "Server moved",
+	0x9E: "Shared Subscriptions not supported",
+	0x9F: "Connection rate exceeded",
+	0xA0: "Maximum connect time",
+	0xA1: "Subscription Identifiers not supported",
+	0xA2: "Wildcard Subscriptions not supported",
+}
+
+// ReasonCode converts a CONNACK return code of MQTT 3.1.1 to the MQTT 5
+// reason code with the same meaning.
+func ReasonCode(returnCode byte) byte {
+	switch returnCode {
+	case Accepted:
+		return ReasonSuccess
+	case ErrRefusedBadProtocolVersion:
+		return ReasonUnsupportedProtocolVersion
+	case ErrRefusedIDRejected:
+		return ReasonClientIdentifierNotValid
+	case ErrRefusedServerUnavailable:
+		return ReasonServerUnavailable
+	case ErrRefusedBadUsernameOrPassword:
+		return ReasonBadUserNameOrPassword
+	case ErrRefusedNotAuthorised:
+		return ReasonNotAuthorized
+	case ErrProtocolViolation:
+		return ReasonProtocolError
+	}
+	return ReasonUnspecifiedError
+}
+
 var ConnErrors = map[byte]error{
 	Accepted:                        nil,
 	ErrRefusedBadProtocolVersion:    errors.New("Unnacceptable protocol version"),
@@ -89,7 +219,7 @@ var ConnErrors = map[byte]error{
 
 func decodeByte(r io.Reader) (byte, error) {
 	num := make([]byte, 1)
-	_, err := r.Read(num)
+	_, err := io.ReadFull(r, num)
 	if err != nil {
 		return 0, err
 	}
@@ -98,7 +228,7 @@ func decodeByte(r io.Reader) (byte, error) {
 
 func decodeUint16(r io.Reader) (uint16, error) {
 	num := make([]byte, 2)
-	_, err := r.Read(num)
+	_, err := io.ReadFull(r, num)
 	if err != nil {
 		return 0, err
 	}
@@ -111,6 +241,12 @@ func encodeUint16(num uint16) []byte {
 	return bytes
 }
 
+func encodeUint32(num uint32) []byte {
+	bytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytes, num)
+	return bytes
+}
+
 func encodeString(field string) []byte {
 	fieldLength := make([]byte, 2)
 	binary.BigEndian.PutUint16(fieldLength, uint16(len(field)))
@@ -124,7 +260,7 @@ func decodeString(r io.Reader) (string, error) {
 	}
 
 	field := make([]byte, fieldLength)
-	_, err = r.Read(field)
+	_, err = io.ReadFull(r, field)
 	if err != nil {
 		return "", err
 	}
@@ -137,7 +273,7 @@ func decodeBytes(r io.Reader) ([]byte, error) {
 		return nil, err
 	}
 	field := make([]byte, fieldLength)
-	_, err = r.Read(field)
+	_, err = io.ReadFull(r, field)
 	if err != nil {
 		return nil, err
 	}
@@ -181,6 +317,10 @@ func decodeLength(r io.Reader) (int, error) {
 			break
 		}
 		multiplier += 7
+		if multiplier > 21 {
+			// at most four bytes
+			return 0, errors.New("Malformed variable byte integer")
+		}
 	}
 	return int(rLength), nil
 }
@@ -191,6 +331,27 @@ type FixedHeader struct {
 	Qos             byte
 	Retain          bool
 	RemainingLength int
+
+	// The protocol version the packet is encoded for. It is not part of
+	// the fixed header on the wire.
+	version byte
+}
+
+// Version returns the protocol version the packet is encoded for. Zero
+// stands for the versions before MQTT 5.
+func (fh *FixedHeader) Version() byte {
+	return fh.version
+}
+
+// SetVersion sets the protocol version the packet is encoded for. Only
+// Version5 changes the encoding; properties and reason codes are left
+// out for the earlier versions.
+func (fh *FixedHeader) SetVersion(version byte) {
+	fh.version = version
+}
+
+func (fh *FixedHeader) v5() bool {
+	return fh.version == Version5
 }
 
 func (fh FixedHeader) String() string {
@@ -223,6 +384,54 @@ func (fh *FixedHeader) unpack(typeAndFlags byte, r io.Reader) error {
 	return err
 }
 
+// packReason encodes the reason code and properties that end the
+// variable header of several MQTT 5 packets. Both may be left out when
+// they have their default values: success and no properties.
+func packReason(reason byte, props *Properties) []byte {
+	p := props.pack()
+	if len(p) == 1 {
+		if reason == ReasonSuccess {
+			return nil
+		}
+		return []byte{reason}
+	}
+	return append([]byte{reason}, p...)
+}
+
+// unpackReason decodes what packReason encoded, given the number of bytes
+// left in the packet.
+func unpackReason(r io.Reader, n int) (reason byte, props *Properties, err error) {
+	if n < 1 {
+		return ReasonSuccess, nil, nil
+	}
+	reason, err = decodeByte(r)
+	if err != nil || n < 2 {
+		return reason, nil, err
+	}
+	props = &Properties{}
+	_, err = props.unpack(r, n-1)
+	return reason, props, err
+}
+
+// packAck encodes the variable header of PUBACK, PUBREC, PUBREL and
+// PUBCOMP: the packet id, then for MQTT 5 the reason code and properties.
+func packAck(fh *FixedHeader, id uint16, reason byte, props *Properties) []byte {
+	b := encodeUint16(id)
+	if fh.v5() {
+		b = append(b, packReason(reason, props)...)
+	}
+	return b
+}
+
+func unpackAck(fh *FixedHeader, r io.Reader) (id uint16, reason byte, props *Properties, err error) {
+	id, err = decodeUint16(r)
+	if err != nil || !fh.v5() {
+		return id, ReasonSuccess, nil, err
+	}
+	reason, props, err = unpackReason(r, fh.RemainingLength-2)
+	return id, reason, props, err
+}
+
 func NewControlPacketWithHeader(fh FixedHeader) (cp ControlPacket) {
 	switch fh.PacketType {
 	case Connect:
@@ -253,6 +462,8 @@ func NewControlPacketWithHeader(fh FixedHeader) (cp ControlPacket) {
 		cp = &PingreqPacket{FixedHeader: fh}
 	case Pingresp:
 		cp = &PingrespPacket{FixedHeader: fh}
+	case Auth:
+		cp = &AuthPacket{FixedHeader: fh}
 	default:
 		return nil
 	}
@@ -289,21 +500,59 @@ func NewControlPacket(packetType byte) (cp ControlPacket) {
 		cp = &PingreqPacket{FixedHeader: FixedHeader{PacketType: Pingreq}}
 	case Pingresp:
 		cp = &PingrespPacket{FixedHeader: FixedHeader{PacketType: Pingresp}}
+	case Auth:
+		cp = &AuthPacket{FixedHeader: FixedHeader{PacketType: Auth}}
 	default:
 		return nil
 	}
 	return cp
 }
 
+// NewControlPacketWithVersion is like NewControlPacket, for a packet
+// encoded for the given protocol version.
+func NewControlPacketWithVersion(packetType byte, version byte) ControlPacket {
+	cp := NewControlPacket(packetType)
+	if cp != nil {
+		cp.SetVersion(version)
+	}
+	return cp
+}
+
+// ReadPacket reads a packet of MQTT 3.1.1 or earlier. A CONNECT is
+// decoded according to the protocol version it carries.
 func ReadPacket(r io.Reader) (cp ControlPacket, err error) {
-	var fh FixedHeader
+	return ReadPacketVersion(r, 0)
+}
+
+// ReadPacketVersion reads a packet encoded for the given protocol
+// version, as negotiated by the CONNECT of the connection.
+func ReadPacketVersion(r io.Reader, version byte) (cp ControlPacket, err error) {
+	return ReadPacketMax(r, version, 0)
+}
+
+// ErrPacketTooLarge is returned by ReadPacketMax for a packet larger than
+// the maximum size.
+var ErrPacketTooLarge = errors.New("Packet too large")
+
+// ReadPacketMax reads a packet like ReadPacketVersion, but returns
+// ErrPacketTooLarge without reading the rest of it if the fixed header
+// announces a packet of more than max bytes, so that an untrusted peer
+// cannot make it allocate up to the 256 MB a packet may take. A max of
+// 0 means no limit.
+func ReadPacketMax(r io.Reader, version byte, max int) (cp ControlPacket, err error) {
+	fh := FixedHeader{version: version}
 	b := make([]byte, 1)
 
 	_, err = io.ReadFull(r, b)
 	if err != nil {
 		return nil, err
 	}
-	fh.unpack(b[0], r)
+	if err = fh.unpack(b[0], r); err != nil {
+		return nil, err
+	}
+	if max > 0 && 1+len(encodeLength(fh.RemainingLength))+fh.RemainingLength > max {
+		return nil, ErrPacketTooLarge
+	}
 	cp = NewControlPacketWithHeader(fh)
 	if cp == nil {
 		return nil, errors.New("Bad data from client")
@@ -316,3 +565,18 @@ func ReadPacket(r io.Reader) (cp ControlPacket, err error) {
 	err = cp.ReadFrom(bytes.NewBuffer(packetBytes))
 	return cp, err
 }
+
+// Size returns the number of bytes a packet takes on the wire, encoded
+// for its protocol version.
+func Size(cp ControlPacket) int {
+	var n byteCounter
+	cp.WriteTo(&n)
+	return int(n)
+}
+
+type byteCounter int
+
+func (n *byteCounter) Write(b []byte) (int, error) {
+	*n += byteCounter(len(b))
+	return len(b), nil
+}
@@ -0,0 +1,344 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestReadPacketMax(t *testing.T) {
+	// A packet within the limit may still claim properties far beyond it;
+	// decoding it must fail without allocating what they claim.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := ReadPacketMax(bytes.NewReader(hugeProperties), Version5, 1<<20)
+	runtime.ReadMemStats(&after)
+	if err == nil {
+		t.Fatal("no error for properties longer than the packet")
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Fatalf("allocated %d bytes decoding a packet of %d", n, len(hugeProperties))
+	}
+
+	// A packet announcing more than the limit is not read at all.
+	big := []byte{0x30, 0xFF, 0xFF, 0xFF, 0x7F}
+	if _, err := ReadPacketMax(bytes.NewReader(big), Version5, 1<<20); err != ErrPacketTooLarge {
+		t.Fatalf("got %v, want %v", err, ErrPacketTooLarge)
+	}
+	if _, err := ReadPacketMax(bytes.NewReader(hugeProperties), Version5, len(hugeProperties)-1); err != ErrPacketTooLarge {
+		t.Fatalf("got %v, want %v", err, ErrPacketTooLarge)
+	}
+}
+
+// v5 returns a fixed header of a packet encoded for MQTT 5.
+func v5(packetType, qos byte) FixedHeader {
+	return FixedHeader{PacketType: packetType, Qos: qos, version: Version5}
+}
+
+// roundTrip encodes a packet and decodes it again for the given version,
+// checking that the whole encoding is read.
+func roundTrip(t *testing.T, cp ControlPacket, version byte) ControlPacket {
+	t.Helper()
+	var b bytes.Buffer
+	if err := cp.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(b.Bytes())
+	got, err := ReadPacketVersion(r, version)
+	if err != nil {
+		t.Fatalf("%v: %v", cp, err)
+	}
+	if r.Len() != 0 {
+		t.Fatalf("%v: %d bytes left over", cp, r.Len())
+	}
+	return got
+}
+
+func TestRoundTripV5(t *testing.T) {
+	tests := []ControlPacket{
+		&ConnectPacket{
+			FixedHeader:      v5(Connect, 0),
+			ProtocolName:     "MQTT",
+			ProtocolVersion:  Version5,
+			CleanSession:     true,
+			WillFlag:         true,
+			WillQos:          2,
+			WillRetain:       true,
+			UsernameFlag:     true,
+			PasswordFlag:     true,
+			KeepaliveTimer:   60,
+			ClientIdentifier: "client",
+			WillTopic:        "will/topic",
+			WillMessage:      []byte("bye"),
+			Username:         "user",
+			Password:         []byte("secret"),
+			Properties: &Properties{
+				SessionExpiryInterval: Uint32(3600),
+				ReceiveMaximum:        Uint16(20),
+				MaximumPacketSize:     Uint32(1 << 16),
+				TopicAliasMaximum:     Uint16(10),
+				RequestResponseInfo:   Byte(1),
+				RequestProblemInfo:    Byte(0),
+				User:                  []UserProperty{{"k", "v"}},
+				AuthMethod:            "SCRAM-SHA-256",
+				AuthData:              []byte("n,,n=user,r=nonce"),
+			},
+			WillProperties: &Properties{
+				WillDelayInterval: Uint32(5),
+				PayloadFormat:     Byte(1),
+				MessageExpiry:     Uint32(60),
+				ContentType:       "text/plain",
+				ResponseTopic:     "reply",
+				CorrelationData:   []byte{1, 2},
+				User:              []UserProperty{{"a", "b"}},
+			},
+		},
+		&ConnectPacket{
+			FixedHeader:     v5(Connect, 0),
+			ProtocolName:    "MQTT",
+			ProtocolVersion: Version5,
+			Properties:      &Properties{},
+		},
+		&ConnackPacket{
+			FixedHeader:    v5(Connack, 0),
+			SessionPresent: true,
+			ReturnCode:     ReasonSuccess,
+			Properties: &Properties{
+				SessionExpiryInterval: Uint32(0),
+				ReceiveMaximum:        Uint16(100),
+				MaximumQos:            Byte(1),
+				RetainAvailable:       Byte(0),
+				MaximumPacketSize:     Uint32(1 << 20),
+				AssignedClientID:      "auto-1",
+				TopicAliasMaximum:     Uint16(5),
+				ReasonString:          "welcome",
+				User:                  []UserProperty{{"k", "v"}},
+				WildcardSubAvailable:  Byte(1),
+				SubIDAvailable:        Byte(1),
+				SharedSubAvailable:    Byte(0),
+				ServerKeepAlive:       Uint16(30),
+				ResponseInfo:          "responses/",
+				ServerReference:       "other:1883",
+				AuthMethod:            "SCRAM-SHA-256",
+				AuthData:              []byte("v=signature"),
+			},
+		},
+		&ConnackPacket{FixedHeader: v5(Connack, 0), ReturnCode: ReasonNotAuthorized, Properties: &Properties{}},
+		&PublishPacket{
+			FixedHeader: v5(Publish, 0),
+			TopicName:   "",
+			Payload:     []byte("aliased"),
+			Properties: &Properties{
+				PayloadFormat:          Byte(1),
+				MessageExpiry:          Uint32(30),
+				TopicAlias:             Uint16(3),
+				ResponseTopic:          "reply",
+				CorrelationData:        []byte("id"),
+				User:                   []UserProperty{{"k", "v"}, {"k", "v2"}},
+				SubscriptionIdentifier: []int{1, 268435455},
+				ContentType:            "text/plain",
+			},
+		},
+		&PublishPacket{
+			FixedHeader: FixedHeader{PacketType: Publish, Dup: true, Qos: 2, Retain: true, version: Version5},
+			TopicName:   "a/b",
+			PacketID:    65535,
+			Payload:     []byte{0},
+			Properties:  &Properties{},
+		},
+		&PubackPacket{FixedHeader: v5(Puback, 0), PacketID: 1},
+		&PubackPacket{FixedHeader: v5(Puback, 0), PacketID: 2, ReasonCode: ReasonNoMatchingSubscribers},
+		&PubackPacket{FixedHeader: v5(Puback, 0), PacketID: 3, ReasonCode: ReasonQuotaExceeded,
+			Properties: &Properties{ReasonString: "full", User: []UserProperty{{"k", "v"}}}},
+		&PubrecPacket{FixedHeader: v5(Pubrec, 0), PacketID: 4, ReasonCode: ReasonUnspecifiedError,
+			Properties: &Properties{ReasonString: "no"}},
+		&PubrelPacket{FixedHeader: v5(Pubrel, 1), PacketID: 5, ReasonCode: ReasonPacketIdentifierNotFound},
+		&PubcompPacket{FixedHeader: v5(Pubcomp, 0), PacketID: 6},
+		&SubscribePacket{
+			FixedHeader: v5(Subscribe, 1),
+			PacketID:    7,
+			Topics:      []string{"a/+", "$share/g/b/#", "c"},
+			Qoss:        []byte{0, 1, 2},
+			Options: []SubscriptionOptions{
+				{},
+				{NoLocal: true, RetainAsPublished: true},
+				{RetainHandling: 2},
+			},
+			Properties: &Properties{SubscriptionIdentifier: []int{42}, User: []UserProperty{{"k", "v"}}},
+		},
+		&SubackPacket{
+			FixedHeader: v5(Suback, 0),
+			PacketID:    7,
+			GrantedQoss: []byte{ReasonGrantedQoS0, ReasonGrantedQoS1, ReasonGrantedQoS2, ReasonNotAuthorized},
+			Properties:  &Properties{ReasonString: "partly"},
+		},
+		&UnsubscribePacket{
+			FixedHeader: v5(Unsubscribe, 1),
+			PacketID:    8,
+			Topics:      []string{"a/+", "c"},
+			Properties:  &Properties{User: []UserProperty{{"k", "v"}}},
+		},
+		&UnsubackPacket{
+			FixedHeader: v5(Unsuback, 0),
+			PacketID:    8,
+			ReasonCodes: []byte{ReasonSuccess, ReasonNoSubscriptionExisted},
+			Properties:  &Properties{},
+		},
+		&PingreqPacket{FixedHeader: v5(Pingreq, 0)},
+		&PingrespPacket{FixedHeader: v5(Pingresp, 0)},
+		&DisconnectPacket{FixedHeader: v5(Disconnect, 0)},
+		&DisconnectPacket{FixedHeader: v5(Disconnect, 0), ReasonCode: ReasonDisconnectWithWill},
+		&DisconnectPacket{FixedHeader: v5(Disconnect, 0), ReasonCode: ReasonUseAnotherServer,
+			Properties: &Properties{ServerReference: "other:1883", ReasonString: "moved", SessionExpiryInterval: Uint32(0)}},
+		&AuthPacket{FixedHeader: v5(Auth, 0)},
+		&AuthPacket{FixedHeader: v5(Auth, 0), ReasonCode: ReasonContinueAuthentication,
+			Properties: &Properties{AuthMethod: "SCRAM-SHA-256", AuthData: []byte("r=nonce,s=salt,i=4096")}},
+	}
+	for _, cp := range tests {
+		got := roundTrip(t, cp, Version5)
+		if !reflect.DeepEqual(got, cp) {
+			t.Errorf("got\n%v\nwant\n%v", got, cp)
+		}
+	}
+}
+
+// The reason codes each packet may carry, by the MQTT 5 specification.
+var packetReasonCodes = map[byte][]byte{
+	Puback:   {0x00, 0x10, 0x80, 0x83, 0x87, 0x90, 0x91, 0x97, 0x99},
+	Pubrec:   {0x00, 0x10, 0x80, 0x83, 0x87, 0x90, 0x91, 0x97, 0x99},
+	Pubrel:   {0x00, 0x92},
+	Suback:   {0x00, 0x01, 0x02, 0x80, 0x83, 0x87, 0x8F, 0x91, 0x97, 0x9E, 0xA1, 0xA2},
+	Unsuback: {0x00, 0x11, 0x80, 0x83, 0x87, 0x8F, 0x91},
+	Disconnect: {0x00, 0x04, 0x80, 0x81, 0x82, 0x83, 0x87, 0x89, 0x8B, 0x8D, 0x8E, 0x8F, 0x90, 0x93,
+		0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9A, 0x9B, 0x9C, 0x9D, 0x9E, 0x9F, 0xA0, 0xA1, 0xA2},
+	Auth: {0x00, 0x18, 0x19},
+}
+
+func TestReasonCodesRoundTrip(t *testing.T) {
+	for packetType, codes := range packetReasonCodes {
+		for _, code := range codes {
+			if ReasonCodes[code] == "" {
+				t.Errorf("reason code 0x%02X has no name", code)
+			}
+			// With no properties, as most are sent, and with some.
+			for _, props := range []*Properties{nil, {ReasonString: fmt.Sprintf("code 0x%02X", code)}} {
+				var cp ControlPacket
+				switch packetType {
+				case Puback:
+					cp = &PubackPacket{FixedHeader: v5(Puback, 0), PacketID: 1, ReasonCode: code, Properties: props}
+				case Pubrec:
+					cp = &PubrecPacket{FixedHeader: v5(Pubrec, 0), PacketID: 1, ReasonCode: code, Properties: props}
+				case Pubrel:
+					cp = &PubrelPacket{FixedHeader: v5(Pubrel, 1), PacketID: 1, ReasonCode: code, Properties: props}
+				case Suback:
+					cp = &SubackPacket{FixedHeader: v5(Suback, 0), PacketID: 1, GrantedQoss: []byte{code, code}, Properties: props}
+				case Unsuback:
+					cp = &UnsubackPacket{FixedHeader: v5(Unsuback, 0), PacketID: 1, ReasonCodes: []byte{code}, Properties: props}
+				case Disconnect:
+					cp = &DisconnectPacket{FixedHeader: v5(Disconnect, 0), ReasonCode: code, Properties: props}
+				case Auth:
+					cp = &AuthPacket{FixedHeader: v5(Auth, 0), ReasonCode: code, Properties: props}
+				}
+				// SUBACK and UNSUBACK always carry their properties.
+				if props == nil && (packetType == Suback || packetType == Unsuback) {
+					reflect.ValueOf(cp).Elem().FieldByName("Properties").Set(reflect.ValueOf(&Properties{}))
+				}
+				if got := roundTrip(t, cp, Version5); !reflect.DeepEqual(got, cp) {
+					t.Errorf("got\n%v\nwant\n%v", got, cp)
+				}
+			}
+		}
+	}
+}
+
+// Packets of MQTT 3.1.1 and their encodings, which MQTT 5 must leave as
+// they were: what only MQTT 5 has is set, and not encoded.
+var v311Tests = []struct {
+	cp   ControlPacket
+	want []byte
+}{
+	{&ConnectPacket{
+		FixedHeader:      FixedHeader{PacketType: Connect},
+		ProtocolName:     "MQTT",
+		ProtocolVersion:  Version311,
+		CleanSession:     true,
+		WillFlag:         true,
+		WillQos:          1,
+		UsernameFlag:     true,
+		PasswordFlag:     true,
+		KeepaliveTimer:   60,
+		ClientIdentifier: "c",
+		WillTopic:        "w",
+		WillMessage:      []byte("m"),
+		Username:         "u",
+		Password:         []byte("p"),
+		Properties:       &Properties{SessionExpiryInterval: Uint32(60)},
+		WillProperties:   &Properties{WillDelayInterval: Uint32(5)},
+	}, []byte{0x10, 25, 0, 4, 'M', 'Q', 'T', 'T', 4, 0xCE, 0, 60,
+		0, 1, 'c', 0, 1, 'w', 0, 1, 'm', 0, 1, 'u', 0, 1, 'p'}},
+	{&ConnectPacket{
+		FixedHeader:      FixedHeader{PacketType: Connect},
+		ProtocolName:     "MQIsdp",
+		ProtocolVersion:  Version31,
+		KeepaliveTimer:   10,
+		ClientIdentifier: "c",
+	}, []byte{0x10, 15, 0, 6, 'M', 'Q', 'I', 's', 'd', 'p', 3, 0, 0, 10, 0, 1, 'c'}},
+	{&ConnackPacket{FixedHeader: FixedHeader{PacketType: Connack}, SessionPresent: true, ReturnCode: ErrRefusedNotAuthorised,
+		Properties: &Properties{ReasonString: "no"}},
+		[]byte{0x20, 2, 1, 5}},
+	{&PublishPacket{FixedHeader: FixedHeader{PacketType: Publish, Qos: 1, Retain: true}, TopicName: "a/b", PacketID: 10,
+		Payload: []byte("hi"), Properties: &Properties{TopicAlias: Uint16(1)}},
+		[]byte{0x33, 9, 0, 3, 'a', '/', 'b', 0, 10, 'h', 'i'}},
+	{&PublishPacket{FixedHeader: FixedHeader{PacketType: Publish, Dup: true, Qos: 2}, TopicName: "t", PacketID: 1, Payload: []byte("x")},
+		[]byte{0x3C, 6, 0, 1, 't', 0, 1, 'x'}},
+	{&PubackPacket{FixedHeader: FixedHeader{PacketType: Puback}, PacketID: 10, ReasonCode: ReasonQuotaExceeded},
+		[]byte{0x40, 2, 0, 10}},
+	{&PubrecPacket{FixedHeader: FixedHeader{PacketType: Pubrec}, PacketID: 10, ReasonCode: ReasonUnspecifiedError},
+		[]byte{0x50, 2, 0, 10}},
+	{&PubrelPacket{FixedHeader: FixedHeader{PacketType: Pubrel, Qos: 1}, PacketID: 10, ReasonCode: ReasonPacketIdentifierNotFound},
+		[]byte{0x62, 2, 0, 10}},
+	{&PubcompPacket{FixedHeader: FixedHeader{PacketType: Pubcomp}, PacketID: 10},
+		[]byte{0x70, 2, 0, 10}},
+	{&SubscribePacket{FixedHeader: FixedHeader{PacketType: Subscribe, Qos: 1}, PacketID: 1,
+		Topics: []string{"a", "b/#"}, Qoss: []byte{1, 2},
+		Options:    []SubscriptionOptions{{NoLocal: true}, {RetainHandling: 2}},
+		Properties: &Properties{SubscriptionIdentifier: []int{5}}},
+		[]byte{0x82, 12, 0, 1, 0, 1, 'a', 1, 0, 3, 'b', '/', '#', 2}},
+	{&SubackPacket{FixedHeader: FixedHeader{PacketType: Suback}, PacketID: 1, GrantedQoss: []byte{1, SubackFailure},
+		Properties: &Properties{ReasonString: "no"}},
+		[]byte{0x90, 4, 0, 1, 1, 0x80}},
+	{&UnsubscribePacket{FixedHeader: FixedHeader{PacketType: Unsubscribe, Qos: 1}, PacketID: 2, Topics: []string{"a"}},
+		[]byte{0xA2, 5, 0, 2, 0, 1, 'a'}},
+	{&UnsubackPacket{FixedHeader: FixedHeader{PacketType: Unsuback}, PacketID: 2,
+		ReasonCodes: []byte{ReasonNoSubscriptionExisted}, Properties: &Properties{}},
+		[]byte{0xB0, 2, 0, 2}},
+	{&PingreqPacket{FixedHeader: FixedHeader{PacketType: Pingreq}}, []byte{0xC0, 0}},
+	{&PingrespPacket{FixedHeader: FixedHeader{PacketType: Pingresp}}, []byte{0xD0, 0}},
+	{&DisconnectPacket{FixedHeader: FixedHeader{PacketType: Disconnect}, ReasonCode: ReasonDisconnectWithWill,
+		Properties: &Properties{ReasonString: "bye"}},
+		[]byte{0xE0, 0}},
+}
+
+func TestEncodingV311(t *testing.T) {
+	for _, tt := range v311Tests {
+		var b bytes.Buffer
+		if err := tt.cp.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), tt.want) {
+			t.Errorf("%s: encoded as % X, want % X", PacketNames[tt.want[0]>>4], b.Bytes(), tt.want)
+			continue
+		}
+		// Decoded, it encodes the same again.
+		got := roundTrip(t, tt.cp, 0)
+		b.Reset()
+		if err := got.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), tt.want) {
+			t.Errorf("%s: decoded and encoded again as % X, want % X", PacketNames[tt.want[0]>>4], b.Bytes(), tt.want)
+		}
+	}
+}
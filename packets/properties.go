@@ -0,0 +1,351 @@
+package packets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Property identifiers of MQTT 5.
+const (
+	PropPayloadFormat          = 0x01
+	PropMessageExpiry          = 0x02
+	PropContentType            = 0x03
+	PropResponseTopic          = 0x08
+	PropCorrelationData        = 0x09
+	PropSubscriptionIdentifier = 0x0B
+	PropSessionExpiryInterval  = 0x11
+	PropAssignedClientID       = 0x12
+	PropServerKeepAlive        = 0x13
+	PropAuthMethod             = 0x15
+	PropAuthData               = 0x16
+	PropRequestProblemInfo     = 0x17
+	PropWillDelayInterval      = 0x18
+	PropRequestResponseInfo    = 0x19
+	PropResponseInfo           = 0x1A
+	PropServerReference        = 0x1C
+	PropReasonString           = 0x1F
+	PropReceiveMaximum         = 0x21
+	PropTopicAliasMaximum      = 0x22
+	PropTopicAlias             = 0x23
+	PropMaximumQos             = 0x24
+	PropRetainAvailable        = 0x25
+	PropUser                   = 0x26
+	PropMaximumPacketSize      = 0x27
+	PropWildcardSubAvailable   = 0x28
+	PropSubIDAvailable         = 0x29
+	PropSharedSubAvailable     = 0x2A
+)
+
+// A UserProperty is a name and value pair sent in the User Property of
+// an MQTT 5 packet.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties holds the properties section of an MQTT 5 packet. Optional
+// numeric properties are pointers, nil when absent; strings and byte
+// slices are absent when empty. Which properties are allowed depends on
+// the packet type; the encoder writes whatever is set.
+type Properties struct {
+	PayloadFormat          *byte
+	MessageExpiry          *uint32
+	ContentType            string
+	ResponseTopic          string
+	CorrelationData        []byte
+	SubscriptionIdentifier []int
+	SessionExpiryInterval  *uint32
+	AssignedClientID       string
+	ServerKeepAlive        *uint16
+	AuthMethod             string
+	AuthData               []byte
+	RequestProblemInfo     *byte
+	WillDelayInterval      *uint32
+	RequestResponseInfo    *byte
+	ResponseInfo           string
+	ServerReference        string
+	ReasonString           string
+	ReceiveMaximum         *uint16
+	TopicAliasMaximum      *uint16
+	TopicAlias             *uint16
+	MaximumQos             *byte
+	RetainAvailable        *byte
+	User                   []UserProperty
+	MaximumPacketSize      *uint32
+	WildcardSubAvailable   *byte
+	SubIDAvailable         *byte
+	SharedSubAvailable     *byte
+}
+
+// Byte, Uint16 and Uint32 return pointers to their argument, for setting
+// optional Properties.
+func Byte(v byte) *byte       { return &v }
+func Uint16(v uint16) *uint16 { return &v }
+func Uint32(v uint32) *uint32 { return &v }
+
+func (p *Properties) String() string {
+	if p == nil {
+		return "properties: none"
+	}
+	return fmt.Sprintf("properties: %+v", *p)
+}
+
+// Copy returns a copy of the properties that shares no memory with the
+// original, or nil if p is nil.
+func (p *Properties) Copy() *Properties {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	pb := func(v *byte) *byte {
+		if v == nil {
+			return nil
+		}
+		return Byte(*v)
+	}
+	p16 := func(v *uint16) *uint16 {
+		if v == nil {
+			return nil
+		}
+		return Uint16(*v)
+	}
+	p32 := func(v *uint32) *uint32 {
+		if v == nil {
+			return nil
+		}
+		return Uint32(*v)
+	}
+	c.PayloadFormat = pb(p.PayloadFormat)
+	c.MessageExpiry = p32(p.MessageExpiry)
+	c.CorrelationData = append([]byte(nil), p.CorrelationData...)
+	c.SubscriptionIdentifier = append([]int(nil), p.SubscriptionIdentifier...)
+	c.SessionExpiryInterval = p32(p.SessionExpiryInterval)
+	c.ServerKeepAlive = p16(p.ServerKeepAlive)
+	c.AuthData = append([]byte(nil), p.AuthData...)
+	c.RequestProblemInfo = pb(p.RequestProblemInfo)
+	c.WillDelayInterval = p32(p.WillDelayInterval)
+	c.RequestResponseInfo = pb(p.RequestResponseInfo)
+	c.ReceiveMaximum = p16(p.ReceiveMaximum)
+	c.TopicAliasMaximum = p16(p.TopicAliasMaximum)
+	c.TopicAlias = p16(p.TopicAlias)
+	c.MaximumQos = pb(p.MaximumQos)
+	c.RetainAvailable = pb(p.RetainAvailable)
+	c.User = append([]UserProperty(nil), p.User...)
+	c.MaximumPacketSize = p32(p.MaximumPacketSize)
+	c.WildcardSubAvailable = pb(p.WildcardSubAvailable)
+	c.SubIDAvailable = pb(p.SubIDAvailable)
+	c.SharedSubAvailable = pb(p.SharedSubAvailable)
+	return &c
+}
+
+// pack encodes the properties, preceded by their length. A nil p encodes
+// as an empty properties section.
+func (p *Properties) pack() []byte {
+	var body bytes.Buffer
+	if p != nil {
+		writeByte := func(id byte, v *byte) {
+			if v != nil {
+				body.WriteByte(id)
+				body.WriteByte(*v)
+			}
+		}
+		writeUint16 := func(id byte, v *uint16) {
+			if v != nil {
+				body.WriteByte(id)
+				body.Write(encodeUint16(*v))
+			}
+		}
+		writeUint32 := func(id byte, v *uint32) {
+			if v != nil {
+				body.WriteByte(id)
+				body.Write(encodeUint32(*v))
+			}
+		}
+		writeString := func(id byte, v string) {
+			if v != "" {
+				body.WriteByte(id)
+				body.Write(encodeString(v))
+			}
+		}
+		writeBytes := func(id byte, v []byte) {
+			if len(v) > 0 {
+				body.WriteByte(id)
+				body.Write(encodeBytes(v))
+			}
+		}
+
+		writeByte(PropPayloadFormat, p.PayloadFormat)
+		writeUint32(PropMessageExpiry, p.MessageExpiry)
+		writeString(PropContentType, p.ContentType)
+		writeString(PropResponseTopic, p.ResponseTopic)
+		writeBytes(PropCorrelationData, p.CorrelationData)
+		for _, id := range p.SubscriptionIdentifier {
+			body.WriteByte(PropSubscriptionIdentifier)
+			body.Write(encodeLength(id))
+		}
+		writeUint32(PropSessionExpiryInterval, p.SessionExpiryInterval)
+		writeString(PropAssignedClientID, p.AssignedClientID)
+		writeUint16(PropServerKeepAlive, p.ServerKeepAlive)
+		writeString(PropAuthMethod, p.AuthMethod)
+		writeBytes(PropAuthData, p.AuthData)
+		writeByte(PropRequestProblemInfo, p.RequestProblemInfo)
+		writeUint32(PropWillDelayInterval, p.WillDelayInterval)
+		writeByte(PropRequestResponseInfo, p.RequestResponseInfo)
+		writeString(PropResponseInfo, p.ResponseInfo)
+		writeString(PropServerReference, p.ServerReference)
+		writeString(PropReasonString, p.ReasonString)
+		writeUint16(PropReceiveMaximum, p.ReceiveMaximum)
+		writeUint16(PropTopicAliasMaximum, p.TopicAliasMaximum)
+		writeUint16(PropTopicAlias, p.TopicAlias)
+		writeByte(PropMaximumQos, p.MaximumQos)
+		writeByte(PropRetainAvailable, p.RetainAvailable)
+		for _, u := range p.User {
+			body.WriteByte(PropUser)
+			body.Write(encodeString(u.Key))
+			body.Write(encodeString(u.Value))
+		}
+		writeUint32(PropMaximumPacketSize, p.MaximumPacketSize)
+		writeByte(PropWildcardSubAvailable, p.WildcardSubAvailable)
+		writeByte(PropSubIDAvailable, p.SubIDAvailable)
+		writeByte(PropSharedSubAvailable, p.SharedSubAvailable)
+	}
+	return append(encodeLength(body.Len()), body.Bytes()...)
+}
+
+// ErrMalformedProperties is returned when the properties section of an
+// MQTT 5 packet cannot be decoded.
+var ErrMalformedProperties = errors.New("Malformed properties")
+
+// unpack decodes a properties section, length included, and returns the
+// number of bytes it took. A section that claims more than the max bytes
+// left in the packet is malformed, and is not read.
+func (p *Properties) unpack(r io.Reader, max int) (int, error) {
+	length, err := decodeLength(r)
+	if err != nil {
+		return 0, err
+	}
+	n := len(encodeLength(length)) + length
+	if n > max {
+		return 0, ErrMalformedProperties
+	}
+
+	buf := make([]byte, length)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+	b := bytes.NewBuffer(buf)
+
+	for b.Len() > 0 {
+		id, _ := b.ReadByte()
+		switch id {
+		case PropPayloadFormat, PropRequestProblemInfo, PropRequestResponseInfo, PropMaximumQos,
+			PropRetainAvailable, PropWildcardSubAvailable, PropSubIDAvailable, PropSharedSubAvailable:
+			v, err := decodeByte(b)
+			if err != nil {
+				return 0, ErrMalformedProperties
+			}
+			switch id {
+			case PropPayloadFormat:
+				p.PayloadFormat = &v
+			case PropRequestProblemInfo:
+				p.RequestProblemInfo = &v
+			case PropRequestResponseInfo:
+				p.RequestResponseInfo = &v
+			case PropMaximumQos:
+				p.MaximumQos = &v
+			case PropRetainAvailable:
+				p.RetainAvailable = &v
+			case PropWildcardSubAvailable:
+				p.WildcardSubAvailable = &v
+			case PropSubIDAvailable:
+				p.SubIDAvailable = &v
+			case PropSharedSubAvailable:
+				p.SharedSubAvailable = &v
+			}
+		case PropServerKeepAlive, PropReceiveMaximum, PropTopicAliasMaximum, PropTopicAlias:
+			if b.Len() < 2 {
+				return 0, ErrMalformedProperties
+			}
+			v, _ := decodeUint16(b)
+			switch id {
+			case PropServerKeepAlive:
+				p.ServerKeepAlive = &v
+			case PropReceiveMaximum:
+				p.ReceiveMaximum = &v
+			case PropTopicAliasMaximum:
+				p.TopicAliasMaximum = &v
+			case PropTopicAlias:
+				p.TopicAlias = &v
+			}
+		case PropMessageExpiry, PropSessionExpiryInterval, PropWillDelayInterval, PropMaximumPacketSize:
+			if b.Len() < 4 {
+				return 0, ErrMalformedProperties
+			}
+			v := binary.BigEndian.Uint32(b.Next(4))
+			switch id {
+			case PropMessageExpiry:
+				p.MessageExpiry = &v
+			case PropSessionExpiryInterval:
+				p.SessionExpiryInterval = &v
+			case PropWillDelayInterval:
+				p.WillDelayInterval = &v
+			case PropMaximumPacketSize:
+				p.MaximumPacketSize = &v
+			}
+		case PropContentType, PropResponseTopic, PropAssignedClientID, PropAuthMethod,
+			PropResponseInfo, PropServerReference, PropReasonString:
+			v, err := decodeString(b)
+			if err != nil {
+				return 0, ErrMalformedProperties
+			}
+			switch id {
+			case PropContentType:
+				p.ContentType = v
+			case PropResponseTopic:
+				p.ResponseTopic = v
+			case PropAssignedClientID:
+				p.AssignedClientID = v
+			case PropAuthMethod:
+				p.AuthMethod = v
+			case PropResponseInfo:
+				p.ResponseInfo = v
+			case PropServerReference:
+				p.ServerReference = v
+			case PropReasonString:
+				p.ReasonString = v
+			}
+		case PropCorrelationData, PropAuthData:
+			v, err := decodeBytes(b)
+			if err != nil {
+				return 0, ErrMalformedProperties
+			}
+			if id == PropCorrelationData {
+				p.CorrelationData = v
+			} else {
+				p.AuthData = v
+			}
+		case PropSubscriptionIdentifier:
+			v, err := decodeLength(b)
+			if err != nil {
+				return 0, ErrMalformedProperties
+			}
+			p.SubscriptionIdentifier = append(p.SubscriptionIdentifier, v)
+		case PropUser:
+			k, err := decodeString(b)
+			if err != nil {
+				return 0, ErrMalformedProperties
+			}
+			v, err := decodeString(b)
+			if err != nil {
+				return 0, ErrMalformedProperties
+			}
+			p.User = append(p.User, UserProperty{Key: k, Value: v})
+		default:
+			return 0, ErrMalformedProperties
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,145 @@
+package packets
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// A v5 PUBLISH whose properties claim 0x0FFFFFFF bytes, in a packet of 9.
+var hugeProperties = []byte{
+	0x30, 7, // PUBLISH, remaining length
+	0, 1, 't', // topic
+	0xFF, 0xFF, 0xFF, 0x7F, // properties length
+}
+
+func TestPropertiesBeyondPacket(t *testing.T) {
+	_, err := ReadPacketVersion(bytes.NewReader(hugeProperties), Version5)
+	if err != ErrMalformedProperties {
+		t.Fatalf("got %v, want %v", err, ErrMalformedProperties)
+	}
+
+	// Properties that fit still decode.
+	p := NewControlPacket(Publish).(*PublishPacket)
+	p.SetVersion(Version5)
+	p.TopicName = "t"
+	p.Payload = []byte("payload")
+	p.Properties = &Properties{ContentType: "text/plain"}
+	var b bytes.Buffer
+	if err := p.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := ReadPacketVersion(&b, Version5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := cp.(*PublishPacket)
+	if got.Properties.ContentType != "text/plain" || string(got.Payload) != "payload" {
+		t.Fatalf("got %q with %+v", got.Payload, got.Properties)
+	}
+}
+
+func TestConnectPropertiesBeyondPacket(t *testing.T) {
+	c := NewControlPacket(Connect).(*ConnectPacket)
+	c.SetVersion(Version5)
+	c.ProtocolName, c.ProtocolVersion = "MQTT", Version5
+	c.ClientIdentifier = "c"
+	c.WillFlag, c.WillTopic, c.WillMessage = true, "w", []byte("bye")
+	c.WillProperties = &Properties{}
+	var b bytes.Buffer
+	if err := c.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	raw := b.Bytes()
+
+	// The will properties, empty, come after the client id; make them
+	// claim more than the packet holds.
+	i := bytes.Index(raw, []byte{0, 1, 'c'}) + 3
+	bad := append(append(append([]byte(nil), raw[:i]...), 0xFF, 0xFF, 0xFF, 0x7F), raw[i+1:]...)
+	bad[1] += 3
+	if _, err := ReadPacketVersion(bytes.NewReader(bad), Version5); err != ErrMalformedProperties {
+		t.Fatalf("got %v, want %v", err, ErrMalformedProperties)
+	}
+}
+
+// One test case for each property: its id, and a value with only it set.
+var propertyTests = []struct {
+	id byte
+	p  Properties
+}{
+	{PropPayloadFormat, Properties{PayloadFormat: Byte(1)}},
+	{PropMessageExpiry, Properties{MessageExpiry: Uint32(3600)}},
+	{PropContentType, Properties{ContentType: "application/json"}},
+	{PropResponseTopic, Properties{ResponseTopic: "reply/to"}},
+	{PropCorrelationData, Properties{CorrelationData: []byte{0, 1, 0xFF}}},
+	{PropSubscriptionIdentifier, Properties{SubscriptionIdentifier: []int{1, 200, 268435455}}},
+	{PropSessionExpiryInterval, Properties{SessionExpiryInterval: Uint32(0xFFFFFFFF)}},
+	{PropAssignedClientID, Properties{AssignedClientID: "auto-1"}},
+	{PropServerKeepAlive, Properties{ServerKeepAlive: Uint16(30)}},
+	{PropAuthMethod, Properties{AuthMethod: "SCRAM-SHA-256"}},
+	{PropAuthData, Properties{AuthData: []byte("n,,n=user,r=nonce")}},
+	{PropRequestProblemInfo, Properties{RequestProblemInfo: Byte(0)}},
+	{PropWillDelayInterval, Properties{WillDelayInterval: Uint32(10)}},
+	{PropRequestResponseInfo, Properties{RequestResponseInfo: Byte(1)}},
+	{PropResponseInfo, Properties{ResponseInfo: "responses/"}},
+	{PropServerReference, Properties{ServerReference: "other:1883"}},
+	{PropReasonString, Properties{ReasonString: "because"}},
+	{PropReceiveMaximum, Properties{ReceiveMaximum: Uint16(0xFFFF)}},
+	{PropTopicAliasMaximum, Properties{TopicAliasMaximum: Uint16(10)}},
+	{PropTopicAlias, Properties{TopicAlias: Uint16(1)}},
+	{PropMaximumQos, Properties{MaximumQos: Byte(1)}},
+	{PropRetainAvailable, Properties{RetainAvailable: Byte(0)}},
+	{PropUser, Properties{User: []UserProperty{{"k", "v"}, {"k", "w"}, {"", ""}}}},
+	{PropMaximumPacketSize, Properties{MaximumPacketSize: Uint32(1 << 20)}},
+	{PropWildcardSubAvailable, Properties{WildcardSubAvailable: Byte(0)}},
+	{PropSubIDAvailable, Properties{SubIDAvailable: Byte(1)}},
+	{PropSharedSubAvailable, Properties{SharedSubAvailable: Byte(0)}},
+}
+
+func TestPropertiesRoundTrip(t *testing.T) {
+	if n := reflect.TypeOf(Properties{}).NumField(); len(propertyTests) != n {
+		t.Fatalf("%d property tests for %d properties", len(propertyTests), n)
+	}
+	var all Properties
+	for _, tt := range propertyTests {
+		b := tt.p.pack()
+		if len(b) < 2 || b[1] != tt.id {
+			t.Errorf("property 0x%02X: encoded as % X", tt.id, b)
+			continue
+		}
+		var got Properties
+		n, err := got.unpack(bytes.NewReader(b), len(b))
+		if err != nil || n != len(b) {
+			t.Errorf("property 0x%02X: read %d of %d bytes, error %v", tt.id, n, len(b), err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.p) {
+			t.Errorf("property 0x%02X: got %+v, want %+v", tt.id, got, tt.p)
+		}
+
+		// Gather them all, each from its own test case.
+		v := reflect.ValueOf(tt.p)
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Field(i).IsZero() {
+				reflect.ValueOf(&all).Elem().Field(i).Set(v.Field(i))
+			}
+		}
+	}
+
+	b := all.pack()
+	var got Properties
+	if _, err := got.unpack(bytes.NewReader(b), len(b)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, all) {
+		t.Fatalf("all properties: got %+v, want %+v", got, all)
+	}
+	if c := all.Copy(); !reflect.DeepEqual(c, &all) {
+		t.Fatalf("copy %+v of %+v", c, all)
+	}
+
+	// An id that is not a property is malformed.
+	if _, err := got.unpack(bytes.NewReader([]byte{2, 0x7F, 0}), 3); err != ErrMalformedProperties {
+		t.Fatalf("unknown property: got %v, want %v", err, ErrMalformedProperties)
+	}
+}
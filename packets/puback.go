@@ -8,19 +8,28 @@ import (
 type PubackPacket struct {
 	FixedHeader
 	PacketID uint16
+
+	// MQTT 5 only.
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (pa *PubackPacket) String() string {
 	str := fmt.Sprintf("%s\n", pa.FixedHeader)
 	str += fmt.Sprintf("messageID: %d", pa.PacketID)
+	if pa.v5() {
+		str += fmt.Sprintf(" reasoncode: %d\n%s", pa.ReasonCode, pa.Properties)
+	}
 	return str
 }
 
 func (pa *PubackPacket) WriteTo(w io.Writer) error {
 	var err error
-	pa.FixedHeader.RemainingLength = 2
+
+	body := packAck(&pa.FixedHeader, pa.PacketID, pa.ReasonCode, pa.Properties)
+	pa.FixedHeader.RemainingLength = len(body)
 	packet := pa.FixedHeader.pack()
-	packet.Write(encodeUint16(pa.PacketID))
+	packet.Write(body)
 	_, err = packet.WriteTo(w)
 
 	return err
@@ -28,7 +37,8 @@ func (pa *PubackPacket) WriteTo(w io.Writer) error {
 
 func (pa *PubackPacket) ReadFrom(r io.Reader) error {
 	var err error
-	pa.PacketID, err = decodeUint16(r)
+
+	pa.PacketID, pa.ReasonCode, pa.Properties, err = unpackAck(&pa.FixedHeader, r)
 	return err
 }
 
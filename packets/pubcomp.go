@@ -8,19 +8,28 @@ import (
 type PubcompPacket struct {
 	FixedHeader
 	PacketID uint16
+
+	// MQTT 5 only.
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (pc *PubcompPacket) String() string {
 	str := fmt.Sprintf("%s\n", pc.FixedHeader)
 	str += fmt.Sprintf("PacketID: %d", pc.PacketID)
+	if pc.v5() {
+		str += fmt.Sprintf(" reasoncode: %d\n%s", pc.ReasonCode, pc.Properties)
+	}
 	return str
 }
 
 func (pc *PubcompPacket) WriteTo(w io.Writer) error {
 	var err error
-	pc.FixedHeader.RemainingLength = 2
+
+	body := packAck(&pc.FixedHeader, pc.PacketID, pc.ReasonCode, pc.Properties)
+	pc.FixedHeader.RemainingLength = len(body)
 	packet := pc.FixedHeader.pack()
-	packet.Write(encodeUint16(pc.PacketID))
+	packet.Write(body)
 	_, err = packet.WriteTo(w)
 
 	return err
@@ -28,7 +37,8 @@ func (pc *PubcompPacket) WriteTo(w io.Writer) error {
 
 func (pc *PubcompPacket) ReadFrom(r io.Reader) error {
 	var err error
-	pc.PacketID, err = decodeUint16(r)
+
+	pc.PacketID, pc.ReasonCode, pc.Properties, err = unpackAck(&pc.FixedHeader, r)
 	return err
 }
 
@@ -2,6 +2,7 @@ package packets
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 )
@@ -11,12 +12,17 @@ type PublishPacket struct {
 	TopicName string
 	PacketID  uint16
 	Payload   []byte
+
+	Properties *Properties // MQTT 5 only
 }
 
 func (p *PublishPacket) String() string {
 	str := fmt.Sprintf("%s\n", p.FixedHeader)
 	str += fmt.Sprintf("topicName: %s PacketID: %d\n", p.TopicName, p.PacketID)
 	str += fmt.Sprintf("payload: %s\n", string(p.Payload))
+	if p.v5() {
+		str += fmt.Sprintf("%s\n", p.Properties)
+	}
 	return str
 }
 
@@ -28,6 +34,9 @@ func (p *PublishPacket) WriteTo(w io.Writer) error {
 	if p.Qos > 0 {
 		body.Write(encodeUint16(p.PacketID))
 	}
+	if p.v5() {
+		body.Write(p.Properties.pack())
+	}
 	p.FixedHeader.RemainingLength = body.Len() + len(p.Payload)
 	packet := p.FixedHeader.pack()
 	packet.Write(body.Bytes())
@@ -54,6 +63,17 @@ func (p *PublishPacket) ReadFrom(r io.Reader) error {
 	} else {
 		payloadLength -= len(p.TopicName) + 2
 	}
+	if p.v5() {
+		p.Properties = &Properties{}
+		n, err := p.Properties.unpack(r, payloadLength)
+		if err != nil {
+			return err
+		}
+		payloadLength -= n
+	}
+	if payloadLength < 0 {
+		return errors.New("Malformed PUBLISH")
+	}
 	p.Payload = make([]byte, payloadLength)
 	_, err = io.ReadFull(r, p.Payload)
 	return err
@@ -8,19 +8,28 @@ import (
 type PubrelPacket struct {
 	FixedHeader
 	PacketID uint16
+
+	// MQTT 5 only.
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (pr *PubrelPacket) String() string {
 	str := fmt.Sprintf("%s\n", pr.FixedHeader)
 	str += fmt.Sprintf("PacketID: %d", pr.PacketID)
+	if pr.v5() {
+		str += fmt.Sprintf(" reasoncode: %d\n%s", pr.ReasonCode, pr.Properties)
+	}
 	return str
 }
 
 func (pr *PubrelPacket) WriteTo(w io.Writer) error {
 	var err error
-	pr.FixedHeader.RemainingLength = 2
+
+	body := packAck(&pr.FixedHeader, pr.PacketID, pr.ReasonCode, pr.Properties)
+	pr.FixedHeader.RemainingLength = len(body)
 	packet := pr.FixedHeader.pack()
-	packet.Write(encodeUint16(pr.PacketID))
+	packet.Write(body)
 	_, err = packet.WriteTo(w)
 
 	return err
@@ -28,7 +37,8 @@ func (pr *PubrelPacket) WriteTo(w io.Writer) error {
 
 func (pr *PubrelPacket) ReadFrom(r io.Reader) error {
 	var err error
-	pr.PacketID, err = decodeUint16(r)
+
+	pr.PacketID, pr.ReasonCode, pr.Properties, err = unpackAck(&pr.FixedHeader, r)
 	return err
 }
 
@@ -6,15 +6,24 @@ import (
 	"io"
 )
 
+// SubackFailure is the return code in GrantedQoss for a topic filter
+// whose subscription was refused.
+const SubackFailure = 0x80
+
 type SubackPacket struct {
 	FixedHeader
 	PacketID    uint16
-	GrantedQoss []byte
+	GrantedQoss []byte // the reason codes for MQTT 5
+
+	Properties *Properties // MQTT 5 only
 }
 
 func (sa *SubackPacket) String() string {
 	str := fmt.Sprintf("%s\n", sa.FixedHeader)
 	str += fmt.Sprintf("PacketID: %d", sa.PacketID)
+	if sa.v5() {
+		str += fmt.Sprintf("\n%s", sa.Properties)
+	}
 	return str
 }
 
@@ -23,6 +32,9 @@ func (sa *SubackPacket) WriteTo(w io.Writer) error {
 	var err error
 
 	body.Write(encodeUint16(sa.PacketID))
+	if sa.v5() {
+		body.Write(sa.Properties.pack())
+	}
 	body.Write(sa.GrantedQoss)
 	sa.FixedHeader.RemainingLength = body.Len()
 	packet := sa.FixedHeader.pack()
@@ -40,6 +52,12 @@ func (sa *SubackPacket) ReadFrom(r io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if sa.v5() {
+		sa.Properties = &Properties{}
+		if _, err = sa.Properties.unpack(r, sa.FixedHeader.RemainingLength-2); err != nil {
+			return err
+		}
+	}
 	_, err = qosBuffer.ReadFrom(r)
 	sa.GrantedQoss = qosBuffer.Bytes()
 	return err
@@ -6,16 +6,31 @@ import (
 	"io"
 )
 
+// SubscriptionOptions are the options of an MQTT 5 subscription besides
+// its QoS, carried in the same byte.
+type SubscriptionOptions struct {
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    byte
+}
+
 type SubscribePacket struct {
 	FixedHeader
 	PacketID uint16
 	Topics   []string
 	Qoss     []byte
+
+	// MQTT 5 only.
+	Options    []SubscriptionOptions // one for each topic
+	Properties *Properties
 }
 
 func (s *SubscribePacket) String() string {
 	str := fmt.Sprintf("%s\n", s.FixedHeader)
 	str += fmt.Sprintf("PacketID: %d topics: %s", s.PacketID, s.Topics)
+	if s.v5() {
+		str += fmt.Sprintf(" options: %v\n%s", s.Options, s.Properties)
+	}
 	return str
 }
 
@@ -24,9 +39,17 @@ func (s *SubscribePacket) WriteTo(w io.Writer) error {
 	var err error
 
 	body.Write(encodeUint16(s.PacketID))
+	if s.v5() {
+		body.Write(s.Properties.pack())
+	}
 	for i, topic := range s.Topics {
 		body.Write(encodeString(topic))
-		body.WriteByte(s.Qoss[i])
+		options := s.Qoss[i]
+		if s.v5() && i < len(s.Options) {
+			o := s.Options[i]
+			options |= boolToByte(o.NoLocal)<<2 | boolToByte(o.RetainAsPublished)<<3 | o.RetainHandling<<4
+		}
+		body.WriteByte(options)
 	}
 	s.FixedHeader.RemainingLength = body.Len()
 	packet := s.FixedHeader.pack()
@@ -38,12 +61,19 @@ func (s *SubscribePacket) WriteTo(w io.Writer) error {
 
 func (s *SubscribePacket) ReadFrom(r io.Reader) error {
 	var err error
-
 	s.PacketID, err = decodeUint16(r)
 	if err != nil {
 		return err
 	}
 	payloadLength := s.FixedHeader.RemainingLength - 2
+	if s.v5() {
+		s.Properties = &Properties{}
+		n, err := s.Properties.unpack(r, payloadLength)
+		if err != nil {
+			return err
+		}
+		payloadLength -= n
+	}
 	for payloadLength > 0 {
 		topic, err := decodeString(r)
 		if err != nil {
@@ -54,6 +84,14 @@ func (s *SubscribePacket) ReadFrom(r io.Reader) error {
 		if err != nil {
 			return err
 		}
+		if s.v5() {
+			s.Options = append(s.Options, SubscriptionOptions{
+				NoLocal:           1&(qos>>2) > 0,
+				RetainAsPublished: 1&(qos>>3) > 0,
+				RetainHandling:    3 & (qos >> 4),
+			})
+			qos &= 3
+		}
 		s.Qoss = append(s.Qoss, qos)
 		payloadLength -= 2 + len(topic) + 1 //2 bytes of string length, plus string, plus 1 byte for Qos
 	}
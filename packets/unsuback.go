@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 )
@@ -8,27 +9,52 @@ import (
 type UnsubackPacket struct {
 	FixedHeader
 	PacketID uint16
+
+	// MQTT 5 only.
+	ReasonCodes []byte // one for each topic of the UNSUBSCRIBE
+	Properties  *Properties
 }
 
 func (ua *UnsubackPacket) String() string {
 	str := fmt.Sprintf("%s\n", ua.FixedHeader)
 	str += fmt.Sprintf("PacketID: %d", ua.PacketID)
+	if ua.v5() {
+		str += fmt.Sprintf(" reasoncodes: %v\n%s", ua.ReasonCodes, ua.Properties)
+	}
 	return str
 }
 
 func (ua *UnsubackPacket) WriteTo(w io.Writer) error {
+	var body bytes.Buffer
 	var err error
-	ua.FixedHeader.RemainingLength = 2
+
+	body.Write(encodeUint16(ua.PacketID))
+	if ua.v5() {
+		body.Write(ua.Properties.pack())
+		body.Write(ua.ReasonCodes)
+	}
+	ua.FixedHeader.RemainingLength = body.Len()
 	packet := ua.FixedHeader.pack()
-	packet.Write(encodeUint16(ua.PacketID))
+	packet.Write(body.Bytes())
 	_, err = packet.WriteTo(w)
 
 	return err
 }
 
 func (ua *UnsubackPacket) ReadFrom(r io.Reader) error {
+	var codes bytes.Buffer
 	var err error
+
 	ua.PacketID, err = decodeUint16(r)
+	if err != nil || !ua.v5() {
+		return err
+	}
+	ua.Properties = &Properties{}
+	if _, err = ua.Properties.unpack(r, ua.FixedHeader.RemainingLength-2); err != nil {
+		return err
+	}
+	_, err = codes.ReadFrom(r)
+	ua.ReasonCodes = codes.Bytes()
 	return err
 }
 
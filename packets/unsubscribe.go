@@ -10,11 +10,16 @@ type UnsubscribePacket struct {
 	FixedHeader
 	PacketID uint16
 	Topics   []string
+
+	Properties *Properties // MQTT 5 only
 }
 
 func (u *UnsubscribePacket) String() string {
 	str := fmt.Sprintf("%s\n", u.FixedHeader)
-	str += fmt.Sprintf("PacketID: %d", u.PacketID)
+	str += fmt.Sprintf("PacketID: %d topics: %s", u.PacketID, u.Topics)
+	if u.v5() {
+		str += fmt.Sprintf("\n%s", u.Properties)
+	}
 	return str
 }
 
@@ -23,6 +28,9 @@ func (u *UnsubscribePacket) WriteTo(w io.Writer) error {
 	var err error
 
 	body.Write(encodeUint16(u.PacketID))
+	if u.v5() {
+		body.Write(u.Properties.pack())
+	}
 	for _, topic := range u.Topics {
 		body.Write(encodeString(topic))
 	}
@@ -36,16 +44,29 @@ func (u *UnsubscribePacket) WriteTo(w io.Writer) error {
 
 func (u *UnsubscribePacket) ReadFrom(r io.Reader) error {
 	var err error
-	var topic string
 
 	u.PacketID, err = decodeUint16(r)
 	if err != nil {
-		return nil
+		return err
 	}
-	for topic, err = decodeString(r); err == nil; topic, err = decodeString(r) {
+	payloadLength := u.FixedHeader.RemainingLength - 2
+	if u.v5() {
+		u.Properties = &Properties{}
+		n, err := u.Properties.unpack(r, payloadLength)
+		if err != nil {
+			return err
+		}
+		payloadLength -= n
+	}
+	for payloadLength > 0 {
+		topic, err := decodeString(r)
+		if err != nil {
+			return err
+		}
 		u.Topics = append(u.Topics, topic)
+		payloadLength -= 2 + len(topic)
 	}
-	return err
+	return nil
 }
 
 func (u *UnsubscribePacket) Details() Details {